@@ -0,0 +1,97 @@
+package demux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/net-agent/protocol/vless"
+	"github.com/net-agent/protocol/vmess"
+)
+
+var ErrUnknownProtocol = errors.New("unknown protocol")
+
+// 识别协议需要读取的长度：vless的版本号与uuid，vmess的认证信息只需要前16字节
+const peekSize = 1 + 16
+
+// 在同一个端口上同时接受vmess与vless连接
+// 根据连接的前几个字节识别协议，交由对应的Session处理，都不匹配时转发到回落目标
+type Session struct {
+	vmess *vmess.Session
+	vless *vless.Session
+
+	fallbacks        utils.Fallbacks
+	handshakeTimeout time.Duration
+	idle             time.Duration
+}
+
+// vm与vl可以为nil，表示不接受该协议
+func NewSession(vm *vmess.Session, vl *vless.Session) *Session {
+	return &Session{
+		vmess:            vm,
+		vless:            vl,
+		handshakeTimeout: utils.DefaultHandshakeTimeout,
+		idle:             utils.DefaultIdleTimeout,
+	}
+}
+
+// 设置识别协议的超时时间，0表示不限制，此时识别失败后立即关闭连接
+func (s *Session) SetHandshakeTimeout(d time.Duration) { s.handshakeTimeout = d }
+
+// 设置回落连接的空闲超时时间
+func (s *Session) SetIdleTimeout(d time.Duration) { s.idle = d }
+
+// 设置无法识别协议时的回落目标，参考utils.Fallbacks
+func (s *Session) SetFallbacks(fbs ...*utils.Fallback) { s.fallbacks = fbs }
+
+func (s *Session) Process(c net.Conn) error {
+	if s.handshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+
+	pc := utils.NewPeekConn(c, nil)
+	buf := make([]byte, peekSize)
+	_, err := io.ReadFull(pc, buf)
+	if err != nil {
+		return s.reject(pc, err)
+	}
+
+	// 已经读取的数据会回放给识别出的Session
+	switch {
+	case s.vless != nil && buf[0] == vless.Version && s.matchVless(buf[1:]):
+		c.SetDeadline(time.Time{})
+		pc.Rewind()
+		return s.vless.Process(pc)
+	case s.vmess != nil && s.vmess.MatchAuthID(buf[:16]):
+		c.SetDeadline(time.Time{})
+		pc.Rewind()
+		return s.vmess.Process(pc, nil)
+	}
+
+	return s.reject(pc, ErrUnknownProtocol)
+}
+
+// 被禁用的用户同样交由vless处理，由vless拒绝
+func (s *Session) matchVless(id []byte) bool {
+	_, err := s.vless.FindUser(id)
+	return err != vless.ErrUserNotFound
+}
+
+// 无法识别协议时优先转发到回落目标，否则读取并丢弃随机长度的数据后关闭连接
+func (s *Session) reject(pc *utils.PeekConn, err error) error {
+	defer pc.Close()
+	if ok, ferr := s.fallbacks.Serve(pc, s.idle); ok {
+		return ferr
+	}
+	if s.handshakeTimeout > 0 {
+		utils.DrainConn(pc)
+	}
+	return err
+}
+
+// maxConns为同时处理的最大连接数，0表示不限制
+func NewServer(s *Session, maxConns int) *utils.Server {
+	return utils.NewServer(s.Process, maxConns)
+}
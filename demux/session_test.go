@@ -0,0 +1,102 @@
+package demux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/net-agent/protocol/vless"
+	"github.com/net-agent/protocol/vmess"
+	"github.com/stretchr/testify/assert"
+)
+
+func runTCPEchoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestSession(t *testing.T) {
+	echoAddr := runTCPEchoServer(t)
+	vmessID := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	vlessID := "27848739-7e62-4138-9fd3-098a63964b6b"
+
+	vm, _ := vmess.NewSession(vmessID)
+	vl, _ := vless.NewSession(vlessID)
+	sess := NewSession(vm, vl)
+	sess.SetHandshakeTimeout(time.Millisecond * 100)
+
+	vmessClient, err := vmess.NewClientFromBytes([]byte(fmt.Sprintf(`{"net":"tcp","add":"127.0.0.1","port":20000,"id":"%v"}`, vmessID)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	vlessClient, err := vless.NewClientFromBytes([]byte(fmt.Sprintf(`{"net":"tcp","add":"127.0.0.1","port":20000,"id":"%v"}`, vlessID)))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name     string
+		upgrade  func(c net.Conn, addrType byte, addrData []byte, port uint16) net.Conn
+		addrType byte
+	}{
+		{"vmess", vmessClient.Upgrade, utils.VmessAddrIPv4},
+		{"vless", vlessClient.Upgrade, utils.VlessAddrIPv4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			go sess.Process(c2)
+			conn := tt.upgrade(c1, tt.addrType, echoAddr.IP.To4(), uint16(echoAddr.Port))
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+			payload := []byte("hello " + tt.name)
+			go conn.Write(payload)
+			buf := make([]byte, len(payload))
+			_, err := io.ReadFull(conn, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, payload, buf)
+		})
+	}
+
+	// 无法识别的数据转发到回落目标
+	c1, c2 := net.Pipe()
+	errch := make(chan error, 1)
+	go func() { errch <- sess.Process(c2) }()
+	go c1.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	assert.Equal(t, ErrUnknownProtocol, <-errch)
+	c1.Close()
+
+	sess.SetFallbacks(&utils.Fallback{Dest: echoAddr.String()})
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	go sess.Process(c2)
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	go c1.Write(req)
+	c1.SetDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, len(req))
+	_, err = io.ReadFull(c1, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, req, buf)
+}
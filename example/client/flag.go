@@ -5,6 +5,8 @@ import (
 	"errors"
 	"flag"
 	"log"
+
+	"github.com/net-agent/protocol/utils"
 )
 
 type ProxyConfig struct {
@@ -14,9 +16,20 @@ type ProxyConfig struct {
 	Address   string `json:"add"`
 	Port      uint16 `json:"port"`
 	Path      string `json:"path"`
+	Host      string `json:"host"` // ws的Host请求头
 	Id        string `json:"id"`
 	Security  string `json:"security"`  // none/auto/aes-128-cfb/aes-128-gcm/chacha20-poly1305
 	Transport string `json:"transport"` // stream/chunk/mask/padding
+	Mux       int    `json:"mux"`       // 单条连接上的最大子连接数，0表示不启用
+	Tls       string `json:"tls"`       // tls/none
+
+	HeaderDelay int `json:"headerDelay"` // 指令的发送时机（毫秒），0表示与第一次写入的数据一起发送
+
+	TLSSettings *utils.TLSConfig `json:"tlsSettings,omitempty"`
+
+	// 服务端使用的证书与私钥文件
+	Cert string `json:"-"`
+	Key  string `json:"-"`
 }
 
 func (p *ProxyConfig) Bytes() []byte {
@@ -31,16 +44,31 @@ func ParseFlag() (string, string, *ProxyConfig, error) {
 	flag.StringVar(&mode, "m", "client", "as client or server: client/server")
 	flag.StringVar(&listen, "l", "", "local listen address, e.g. 'localhost:1234'")
 	flag.StringVar(&cfg.Protocol, "protocol", "vmess", "protocol: vmess/vless")
-	flag.StringVar(&cfg.Network, "net", "tcp", "server network, options: tcp/ws")
+	flag.StringVar(&cfg.Network, "net", "tcp", "server network, options: tcp/ws/wss/h2/grpc")
 	flag.StringVar(&cfg.Address, "add", "", "server address, e.g. 'localhost'")
 	flag.IntVar(&port, "port", 0, "server port, e.g. 80")
-	flag.StringVar(&cfg.Path, "path", "/", "path of websocket")
+	flag.StringVar(&cfg.Path, "path", "/", "path of websocket, append '?ed=2048' to enable early data; service name of grpc")
+	flag.StringVar(&cfg.Host, "host", "", "host header of ws/h2/grpc, default to server address")
 	flag.StringVar(&cfg.Id, "id", "", "uuid")
 	flag.StringVar(&cfg.Security, "security", "", "vmess only, options: none/auto/aes-128-cfb/aes-128-gcm/chacha20-poly1305")
 	flag.StringVar(&cfg.Transport, "transport", "", "vmess only, options: stream/chunk/mask/padding")
+	flag.IntVar(&cfg.Mux, "mux", 0, "max concurrent streams per connection, 0 to disable mux")
+	flag.StringVar(&cfg.Tls, "tls", "", "options: tls/none")
+	flag.IntVar(&cfg.HeaderDelay, "headerDelay", 0, "send request header after ms without data, <0 to send at once, 0 to wait for first write")
+
+	flag.StringVar(&cfg.Cert, "cert", "", "server only, certificate file for tls")
+	flag.StringVar(&cfg.Key, "key", "", "server only, private key file for tls")
+
+	var sni string
+	var insecure bool
+	flag.StringVar(&sni, "sni", "", "tls server name, default to server address")
+	flag.BoolVar(&insecure, "insecure", false, "skip tls certificate verification")
 
 	flag.Parse()
 	cfg.Port = uint16(port)
+	if sni != "" || insecure {
+		cfg.TLSSettings = &utils.TLSConfig{ServerName: sni, Insecure: insecure}
+	}
 
 	if mode == "client" && listen == "" {
 		log.Printf("invalid args, mode='%v' listen='%v'\n", mode, listen)
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/net-agent/protocol/utils"
 	"github.com/net-agent/protocol/vless"
@@ -68,36 +73,65 @@ func RunClient(listen string, config *ProxyConfig) {
 func RunServer(config *ProxyConfig) {
 	log.Printf("run as %v server\n", config.Protocol)
 
-	if config.Protocol != "vless" {
+	var server *utils.Server
+	switch config.Protocol {
+	case "vless":
+		sess, err := vless.NewSession(config.Id)
+		if err != nil {
+			log.Println("init session failed:", err)
+			return
+		}
+		server = vless.NewServer(sess, 0).Server
+	case "vmess":
+		sess, err := vmess.NewSession(config.Id)
+		if err != nil {
+			log.Println("init session failed:", err)
+			return
+		}
+		server = vmess.NewServer(sess, 0).Server
+	default:
 		log.Printf("server protocol not supported")
 		return
 	}
 
-	sess, err := vless.NewSession(config.Id)
-	if err != nil {
-		log.Println("init session failed")
-		return
+	listenConfig := &utils.ListenConfig{
+		Network: config.Network,
+		Address: config.Address,
+		Port:    config.Port,
+		WS:      &utils.WSServerConfig{Path: config.Path, Host: config.Host, EarlyDataHeader: utils.DefaultEarlyDataHeader},
+		H2:      &utils.H2ServerConfig{Path: config.Path, Host: config.Host},
+		GRPC:    &utils.GRPCServerConfig{ServiceName: config.Path, Host: config.Host},
 	}
-
-	addr := fmt.Sprintf("%v:%v", config.Address, config.Port)
-	l, err := net.Listen("tcp", addr)
+	if config.Tls == "tls" {
+		listenConfig.TLS = &utils.TLSServerConfig{
+			Certificates:   []utils.CertFile{{Cert: config.Cert, Key: config.Key}},
+			ReloadInterval: 60,
+		}
+	}
+	l, err := utils.MakeListener(listenConfig)
 	if err != nil {
 		log.Println("listen failed:", err)
 		return
 	}
-	log.Printf("listen: %v\n", addr)
+	log.Printf("listen: %v://%v\n", config.Network, l.Addr())
 
-	for {
-		c, err := l.Accept()
-		if err != nil {
-			return
-		}
+	// 收到退出信号后等待已有连接结束，超时后强制关闭
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
 
-		go func() {
-			err := sess.Process(c)
-			if err != nil {
-				log.Printf("process failed: %v\n", err)
-			}
-		}()
+	err = server.Serve(l)
+	if err != utils.ErrServerClosed {
+		log.Println("serve failed:", err)
+		return
 	}
+	<-stopped
 }
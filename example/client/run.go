@@ -23,18 +23,15 @@ func Run(listen string, dialer Dialer) error {
 
 		log.Printf("accepted. target='%v'\n", req.GetAddrPortStr())
 
-		// 第一阶段：与代理服务器创建连接
+		// 与代理服务器创建连接并升级，启用多路复用时会复用已有连接
 		// TODO：此处可以对多个dialer进行负载均衡
-		c, err := dialer.Connect()
-
+		c, err := dialer.Dial("tcp", t.Byte(dialer.Protocol()), addrData, port)
 		if err != nil {
 			log.Println("connect failed:", err)
 			return nil, err
 		}
 
-		// 第二阶段：将与代理服务器之间的连接进行升级
-		c = dialer.Upgrade(c, t.Byte(dialer.Protocol()), addrData, port)
-		return c, err
+		return c, nil
 	})
 
 	return s.ListenAndRun(listen)
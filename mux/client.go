@@ -0,0 +1,121 @@
+package mux
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+const (
+	DefaultConcurrency = 8
+	KeepAliveInterval  = time.Second * 10
+	IdleTimeout        = time.Second * 30
+)
+
+// 客户端连接池
+// 每条连接上同时存在的子连接数不超过concurrency，超过时创建新的连接
+type Client struct {
+	dial        utils.Dialer
+	concurrency int
+
+	mu       sync.Mutex
+	sessions []*Session
+}
+
+// dial需要返回已经完成协议升级（指令为Mux）的连接
+func NewClient(dial utils.Dialer, concurrency int) *Client {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	return &Client{
+		dial:        dial,
+		concurrency: concurrency,
+	}
+}
+
+// 打开一条子连接，优先复用已有的连接
+func (c *Client) Dial(network byte, t utils.AddrType, addrData []byte, port uint16) (net.Conn, error) {
+	st, err := c.open(network, t, addrData, port)
+	if err != nil {
+		return nil, err
+	}
+
+	err = st.sess.writeFrame(&Frame{
+		SessionID: st.id,
+		Status:    StatusNew,
+		Network:   network,
+		AddrType:  t,
+		AddrData:  addrData,
+		Port:      port,
+	})
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (c *Client) open(network byte, t utils.AddrType, addrData []byte, port uint16) (*Stream, error) {
+	c.mu.Lock()
+	alive := c.sessions[:0]
+	for _, s := range c.sessions {
+		if !s.IsClosed() {
+			alive = append(alive, s)
+		}
+	}
+	c.sessions = alive
+
+	for _, s := range c.sessions {
+		if st, ok := s.open(c.concurrency, network, t, addrData, port); ok {
+			c.mu.Unlock()
+			return st, nil
+		}
+	}
+	c.mu.Unlock()
+
+	// 没有可用的连接，创建新连接
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(conn)
+	go s.run(nil)
+	go s.monitor(KeepAliveInterval, IdleTimeout)
+
+	st, _ := s.open(c.concurrency, network, t, addrData, port)
+
+	c.mu.Lock()
+	c.sessions = append(c.sessions, s)
+	c.mu.Unlock()
+
+	return st, nil
+}
+
+// 当前持有的连接数
+func (c *Client) NumSessions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, s := range c.sessions {
+		if !s.IsClosed() {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	sessions := c.sessions
+	c.sessions = nil
+	c.mu.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 模拟服务端，子连接直接回显收到的数据
+func newEchoClient(concurrency int) (*Client, *int) {
+	dialed := 0
+	client := NewClient(func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		dialed++
+		go Serve(c2, func(st *Stream) error {
+			buf := make([]byte, utils.MaxPacketSize)
+			for {
+				n, err := st.Read(buf)
+				if err != nil {
+					return nil
+				}
+				if _, err = st.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+		})
+		return c1, nil
+	}, concurrency)
+	return client, &dialed
+}
+
+func TestClientStreams(t *testing.T) {
+	client, dialed := newEchoClient(4)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := []net.Conn{}
+	for i := 0; i < 10; i++ {
+		c, err := client.Dial(NetworkTCP, utils.AddrDomain, []byte("example.com"), 80)
+		if !assert.Nil(t, err) {
+			return
+		}
+		conns = append(conns, c)
+	}
+	// 10个子连接，每条连接最多4个，需要3条连接
+	assert.Equal(t, 3, *dialed)
+	assert.Equal(t, 3, client.NumSessions())
+
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			defer c.Close()
+
+			payload := make([]byte, 3*MaxFrameDataSize+100)
+			rand.Read(payload)
+			go c.Write(payload)
+
+			buf := make([]byte, len(payload))
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			_, err := io.ReadFull(c, buf)
+			mu.Lock()
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payload, buf))
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	// 子连接关闭后，连接可以被复用
+	c, err := client.Dial(NetworkTCP, utils.AddrIPv4, []byte{127, 0, 0, 1}, 80)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, 3, *dialed)
+}
+
+func TestClientUDPStream(t *testing.T) {
+	client, _ := newEchoClient(1)
+	defer client.Close()
+
+	c, err := client.Dial(NetworkUDP, utils.AddrIPv4, []byte{8, 8, 8, 8}, 53)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	for _, size := range []int{1, 100, MaxFrameDataSize * 2} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+		go c.Write(payload)
+
+		buf := make([]byte, utils.MaxPacketSize)
+		n, err := c.Read(buf)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(payload, buf[:n]))
+	}
+}
+
+func TestStreamEnd(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewClient(func() (net.Conn, error) { return c1, nil }, 0)
+	defer client.Close()
+
+	go Serve(c2, func(st *Stream) error {
+		st.Write([]byte("bye"))
+		return nil // 返回后子连接被关闭，客户端读到EOF
+	})
+
+	c, err := client.Dial(NetworkTCP, utils.AddrIPv4, []byte{127, 0, 0, 1}, 80)
+	if !assert.Nil(t, err) {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf, err := io.ReadAll(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(buf))
+
+	c.Close()
+	_, err = c.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+// 客户端结束发送后仍然可以读取应答
+func TestStreamCloseWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewClient(func() (net.Conn, error) { return c1, nil }, 0)
+	defer client.Close()
+
+	go Serve(c2, func(st *Stream) error {
+		buf, err := io.ReadAll(st)
+		if err != nil {
+			return err
+		}
+		_, err = st.Write(append(buf, " world"...))
+		return err
+	})
+
+	c, err := client.Dial(NetworkTCP, utils.AddrIPv4, []byte{127, 0, 0, 1}, 80)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	c.Write([]byte("hello"))
+	assert.Nil(t, c.(*Stream).CloseWrite())
+	_, err = c.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	buf, err := io.ReadAll(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(buf))
+}
+
+// 接收缓存已满时等待数据被读取，不丢弃数据
+func TestStreamBackpressure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewClient(func() (net.Conn, error) { return c1, nil }, 0)
+	defer client.Close()
+
+	go Serve(c2, func(st *Stream) error {
+		time.Sleep(time.Millisecond * 200) // 读取前缓存已满
+		_, err := io.Copy(st, st)
+		return err
+	})
+
+	c, err := client.Dial(NetworkTCP, utils.AddrIPv4, []byte{127, 0, 0, 1}, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+
+	data := make([]byte, (streamBufferFrames+2)*MaxFrameDataSize)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+		c.(*Stream).CloseWrite()
+	}()
+	buf, err := io.ReadAll(c)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, buf))
+}
+
+// 会话的写入被其它子连接占用时，写超时仍然生效
+func TestStreamWriteDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := newSession(c1)
+	defer s.Close()
+
+	st1, _ := s.open(2, NetworkTCP, utils.AddrIPv4, []byte{127, 0, 0, 1}, 80)
+	st2, _ := s.open(2, NetworkTCP, utils.AddrIPv4, []byte{127, 0, 0, 1}, 80)
+	go st1.Write([]byte("blocked")) // 对端不读取，一直占用写入
+	time.Sleep(time.Millisecond * 50)
+
+	st2.SetWriteDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err := st2.Write([]byte("hello"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+// 重复的New帧被拒绝，原有的子连接不受影响
+func TestServeDuplicateStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	accepted := make(chan *Stream, 2)
+	go Serve(c2, func(st *Stream) error {
+		accepted <- st
+		_, err := io.Copy(st, st)
+		return err
+	})
+
+	c1.SetDeadline(time.Now().Add(time.Second * 5))
+	newFrame := &Frame{SessionID: 1, Status: StatusNew, Network: NetworkTCP, AddrType: utils.AddrIPv4, AddrData: []byte{127, 0, 0, 1}, Port: 80}
+	_, err := newFrame.WriteTo(c1)
+	assert.Nil(t, err)
+	go newFrame.WriteTo(c1)
+
+	f := &Frame{}
+	_, err = f.ReadFrom(c1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1), f.SessionID)
+	assert.Equal(t, StatusEnd, f.Status)
+	assert.True(t, f.HasOption(OptionError))
+
+	go (&Frame{SessionID: 1, Status: StatusKeep, Option: OptionData, Data: []byte("hello")}).WriteTo(c1)
+	f = &Frame{}
+	_, err = f.ReadFrom(c1)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusKeep, f.Status)
+	assert.Equal(t, "hello", string(f.Data))
+	assert.Equal(t, 1, len(accepted))
+}
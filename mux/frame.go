@@ -0,0 +1,163 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+const (
+	StatusNew       = byte(0x01)
+	StatusKeep      = byte(0x02)
+	StatusEnd       = byte(0x03)
+	StatusKeepAlive = byte(0x04)
+
+	OptionData  = byte(0x01)
+	OptionError = byte(0x02)
+
+	NetworkTCP = byte(0x01)
+	NetworkUDP = byte(0x02)
+)
+
+const maxMetaSize = 512
+const MaxFrameDataSize = 8 * 1024
+
+var ErrInvalidFrame = errors.New("invalid mux frame")
+
+// Mux.Cool的帧结构
+// [MetaLen 2B][Meta][DataLen 2B][Data]
+//
+// Meta: [SessionID 2B][Status 1B][Option 1B][Network 1B][Port 2B][AddrType 1B][Addr]
+// * 目标地址部分仅在New帧中出现，部分实现也会在UDP的Keep帧中携带
+// * 地址类型的取值与VMess相同
+// * DataLen与Data仅在Option包含OptionData时出现
+type Frame struct {
+	SessionID uint16
+	Status    byte
+	Option    byte
+
+	Network  byte
+	AddrType utils.AddrType
+	AddrData []byte
+	Port     uint16
+
+	Data []byte
+}
+
+func (f *Frame) HasOption(op byte) bool { return (f.Option & op) > 0 }
+
+func (f *Frame) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 2, 2+4+4+1+len(f.AddrData)+2+len(f.Data))
+
+	// meta
+	buf = append(buf, byte(f.SessionID>>8), byte(f.SessionID), f.Status, f.Option)
+	if f.Status == StatusNew {
+		buf = append(buf, f.Network, byte(f.Port>>8), byte(f.Port))
+		buf = append(buf, f.AddrType.Byte(utils.ProtoVmess))
+		if f.AddrType == utils.AddrDomain {
+			buf = append(buf, byte(len(f.AddrData)))
+		}
+		buf = append(buf, f.AddrData...)
+	}
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(buf)-2))
+
+	// data
+	if f.HasOption(OptionData) {
+		buf = append(buf, byte(len(f.Data)>>8), byte(len(f.Data)))
+		buf = append(buf, f.Data...)
+	}
+
+	// 整帧一次性写入，保证多个子连接并发写入时帧不会交错
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func (f *Frame) ReadFrom(r io.Reader) (int64, error) {
+	readed := int64(0)
+	sizeBuf := make([]byte, 2)
+
+	n, err := io.ReadFull(r, sizeBuf)
+	readed += int64(n)
+	if err != nil {
+		return readed, err
+	}
+	metaSize := int(binary.BigEndian.Uint16(sizeBuf))
+	if metaSize < 4 || metaSize > maxMetaSize {
+		return readed, ErrInvalidFrame
+	}
+
+	meta := make([]byte, metaSize)
+	n, err = io.ReadFull(r, meta)
+	readed += int64(n)
+	if err != nil {
+		return readed, err
+	}
+	if err = f.parseMeta(meta); err != nil {
+		return readed, err
+	}
+
+	f.Data = nil
+	if f.HasOption(OptionData) {
+		n, err = io.ReadFull(r, sizeBuf)
+		readed += int64(n)
+		if err != nil {
+			return readed, err
+		}
+
+		f.Data = make([]byte, binary.BigEndian.Uint16(sizeBuf))
+		n, err = io.ReadFull(r, f.Data)
+		readed += int64(n)
+		if err != nil {
+			return readed, err
+		}
+	}
+
+	return readed, nil
+}
+
+func (f *Frame) parseMeta(meta []byte) error {
+	f.SessionID = binary.BigEndian.Uint16(meta[0:2])
+	f.Status = meta[2]
+	f.Option = meta[3]
+	f.Network = 0
+	f.AddrType = utils.AddrUnknown
+	f.AddrData = nil
+	f.Port = 0
+
+	// Keep帧中可能携带目标地址，多余的字段（如GlobalID）直接忽略
+	if f.Status != StatusNew && (f.Status != StatusKeep || len(meta) <= 4) {
+		return nil
+	}
+
+	if len(meta) < 4+1+2+1 {
+		return ErrInvalidFrame
+	}
+	f.Network = meta[4]
+	f.Port = binary.BigEndian.Uint16(meta[5:7])
+	f.AddrType = utils.NewAddrType(utils.ProtoVmess, meta[7])
+
+	addr := meta[8:]
+	size := 0
+	switch f.AddrType {
+	case utils.AddrIPv4:
+		size = 4
+	case utils.AddrIPv6:
+		size = 16
+	case utils.AddrDomain:
+		if len(addr) < 1 {
+			return ErrInvalidFrame
+		}
+		size = int(addr[0])
+		addr = addr[1:]
+	default:
+		return utils.ErrInvalidAddrType
+	}
+	if len(addr) < size {
+		return ErrInvalidFrame
+	}
+	f.AddrData = addr[:size]
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame(t *testing.T) {
+	frames := []*Frame{
+		{SessionID: 1, Status: StatusNew, Network: NetworkTCP, AddrType: utils.AddrIPv4, AddrData: []byte{1, 2, 3, 4}, Port: 80},
+		{SessionID: 2, Status: StatusNew, Option: OptionData, Network: NetworkUDP, AddrType: utils.AddrIPv6, AddrData: make([]byte, 16), Port: 53, Data: []byte("hello")},
+		{SessionID: 3, Status: StatusNew, Network: NetworkTCP, AddrType: utils.AddrDomain, AddrData: []byte("v1.mux.cool"), Port: 443},
+		{SessionID: 4, Status: StatusKeep, Option: OptionData, Data: make([]byte, MaxFrameDataSize)},
+		{SessionID: 5, Status: StatusEnd, Option: OptionError},
+		{Status: StatusKeepAlive},
+	}
+
+	for i, f := range frames {
+		t.Run(fmt.Sprintf("testcase-%v", i), func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			_, err := f.WriteTo(buf)
+			assert.Nil(t, err)
+
+			f2 := &Frame{}
+			_, err = f2.ReadFrom(buf)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, f.SessionID, f2.SessionID)
+			assert.Equal(t, f.Status, f2.Status)
+			assert.Equal(t, f.Option, f2.Option)
+			assert.Equal(t, f.Data, f2.Data)
+			if f.Status == StatusNew {
+				assert.Equal(t, f.Network, f2.Network)
+				assert.Equal(t, f.AddrType, f2.AddrType)
+				assert.Equal(t, f.AddrData, f2.AddrData)
+				assert.Equal(t, f.Port, f2.Port)
+			}
+			assert.Equal(t, 0, buf.Len())
+		})
+	}
+}
+
+func TestFrameKeepWithTarget(t *testing.T) {
+	// 部分实现会在UDP的Keep帧中携带目标地址
+	meta := []byte{0, 7, StatusKeep, OptionData, NetworkUDP, 0, 53, utils.VmessAddrIPv4, 8, 8, 8, 8}
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{0, byte(len(meta))})
+	buf.Write(meta)
+	buf.Write([]byte{0, 2, 'h', 'i'})
+
+	f := &Frame{}
+	_, err := f.ReadFrom(buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, uint16(7), f.SessionID)
+	assert.Equal(t, NetworkUDP, f.Network)
+	assert.Equal(t, utils.AddrIPv4, f.AddrType)
+	assert.Equal(t, []byte{8, 8, 8, 8}, f.AddrData)
+	assert.Equal(t, []byte("hi"), f.Data)
+}
@@ -0,0 +1,56 @@
+package mux
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+// 子连接处理函数，返回后子连接会被关闭
+type StreamHandler func(st *Stream) error
+
+// 在已升级的连接上处理Mux.Cool帧，每条新的子连接交由handler处理
+func Serve(c net.Conn, handler StreamHandler) error {
+	s := newSession(c)
+	return s.run(func(st *Stream) {
+		defer st.Close()
+		if err := handler(st); err != nil {
+			log.Printf("mux stream failed: %v\n", err)
+		}
+	})
+}
+
+// 默认的子连接处理：连接目标地址并双向转发
+func DialAndLink(st *Stream) error {
+	addr, err := st.TargetString()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("mux accepted. target='%v'\n", addr)
+
+	switch st.Network() {
+	case NetworkTCP:
+		target, err := utils.Dial(addr)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		utils.LinkAndLog(addr, target, st, utils.DefaultIdleTimeout)
+
+	case NetworkUDP:
+		target, err := utils.DialUDP(addr)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		utils.LinkPacketAndLog(addr, target, st, utils.DefaultPacketIdleTimeout)
+
+	default:
+		return errors.New("invalid network")
+	}
+
+	return nil
+}
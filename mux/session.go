@@ -0,0 +1,235 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+var (
+	ErrSessionClosed = errors.New("mux session closed")
+	ErrRemoteError   = errors.New("mux stream closed by remote with error")
+)
+
+// 单条连接上最多承载的子连接总数，达到后该连接不再接受新的子连接
+const maxStreamsPerSession = 128
+
+// 客户端与服务端共用的多路复用会话，在一条已升级的连接上承载多个子连接
+type Session struct {
+	conn      net.Conn
+	wlock     chan struct{} // 写入锁，等待时可以被超时打断
+	lastWrite int64
+
+	mu      sync.Mutex
+	streams map[uint16]*Stream
+	nextID  uint16
+	opened  int
+	idleAt  time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSession(c net.Conn) *Session {
+	return &Session{
+		conn:      c,
+		wlock:     make(chan struct{}, 1),
+		lastWrite: time.Now().UnixNano(),
+		streams:   make(map[uint16]*Stream),
+		idleAt:    time.Now(),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (s *Session) IsClosed() bool { return isClosedChan(s.closed) }
+
+// 当前活跃的子连接数
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint16]*Stream)
+		s.mu.Unlock()
+
+		for _, st := range streams {
+			st.closeRead(io.ErrUnexpectedEOF)
+		}
+	})
+	return nil
+}
+
+func (s *Session) writeFrame(f *Frame) error {
+	return s.writeFrameDeadline(f, nil)
+}
+
+// timeout关闭后放弃等待写入，返回os.ErrDeadlineExceeded
+func (s *Session) writeFrameDeadline(f *Frame, timeout <-chan struct{}) error {
+	select {
+	case s.wlock <- struct{}{}:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+	defer func() { <-s.wlock }()
+
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+
+	_, err := f.WriteTo(s.conn)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+	return nil
+}
+
+// 在会话上创建新的子连接，会话已满或已关闭时返回false
+func (s *Session) open(limit int, network byte, t utils.AddrType, addrData []byte, port uint16) (*Stream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.IsClosed() || len(s.streams) >= limit || s.opened >= maxStreamsPerSession {
+		return nil, false
+	}
+
+	s.nextID++
+	if s.nextID == 0 {
+		s.nextID = 1
+	}
+	s.opened++
+
+	st := newStream(s, s.nextID, network, t, addrData, port)
+	s.streams[st.id] = st
+	return st, true
+}
+
+func (s *Session) get(id uint16) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// 从会话中移除子连接，ID已经被新的子连接使用时不做处理
+func (s *Session) detach(st *Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+		if len(s.streams) == 0 {
+			s.idleAt = time.Now()
+		}
+	}
+}
+
+// 持续读取并分发帧，直到连接关闭
+// accept为nil时（客户端）不接受对端发起的子连接
+func (s *Session) run(accept func(st *Stream)) error {
+	defer s.Close()
+
+	for {
+		f := &Frame{}
+		_, err := f.ReadFrom(s.conn)
+		if err != nil {
+			if err == io.EOF || s.IsClosed() {
+				return nil
+			}
+			return err
+		}
+
+		switch f.Status {
+		case StatusNew:
+			if accept == nil {
+				s.writeFrame(&Frame{SessionID: f.SessionID, Status: StatusEnd, Option: OptionError})
+				continue
+			}
+			st := newStream(s, f.SessionID, f.Network, f.AddrType, f.AddrData, f.Port)
+			s.mu.Lock()
+			_, exists := s.streams[st.id]
+			if !exists {
+				s.streams[st.id] = st
+			}
+			s.mu.Unlock()
+			if exists {
+				// ID仍在使用中，拒绝新的子连接，原有的子连接不受影响
+				s.writeFrame(&Frame{SessionID: f.SessionID, Status: StatusEnd, Option: OptionError})
+				continue
+			}
+			if f.HasOption(OptionData) {
+				st.push(f.Data)
+			}
+			go accept(st)
+
+		case StatusKeep:
+			st := s.get(f.SessionID)
+			if st == nil {
+				// 子连接已经不存在，通知对端关闭
+				s.writeFrame(&Frame{SessionID: f.SessionID, Status: StatusEnd})
+				continue
+			}
+			if f.HasOption(OptionData) {
+				st.push(f.Data)
+			}
+
+		case StatusEnd:
+			// 对端可能只是结束发送，本端仍然可以继续写入
+			if st := s.get(f.SessionID); st != nil {
+				if f.HasOption(OptionError) {
+					st.reset(ErrRemoteError, false)
+				} else {
+					st.closeRead(io.EOF)
+				}
+			}
+
+		case StatusKeepAlive:
+			// 仅用于保持连接活跃，直接忽略
+
+		default:
+			return ErrInvalidFrame
+		}
+	}
+}
+
+// 客户端会话的保活与空闲回收
+func (s *Session) monitor(keepAlive, idleTimeout time.Duration) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		idle := len(s.streams) == 0 && time.Since(s.idleAt) >= idleTimeout
+		s.mu.Unlock()
+		if idle {
+			s.Close()
+			return
+		}
+
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastWrite))) >= keepAlive {
+			s.writeFrame(&Frame{Status: StatusKeepAlive})
+		}
+	}
+}
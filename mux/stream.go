@@ -0,0 +1,238 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// 每条子连接最多缓存的帧数
+// Mux.Cool没有流量控制，TCP子连接的缓存已满时阻塞会话的读循环，直到数据被读取
+const streamBufferFrames = 64
+
+// 多路复用会话中的一条子连接
+// * TCP子连接是普通的字节流
+// * UDP子连接的每次Read/Write对应一个完整的数据包
+type Stream struct {
+	sess *Session
+	id   uint16
+
+	network  byte
+	addrType utils.AddrType
+	addrData []byte
+	port     uint16
+
+	rch     chan []byte
+	rbuf    []byte
+	rerr    error
+	eof     chan struct{}
+	eofOnce sync.Once
+	rdead   deadline
+
+	wdead      deadline
+	wclosed    chan struct{} // 已经发送End帧
+	wcloseOnce sync.Once
+
+	done     chan struct{}
+	doneOnce sync.Once
+	derr     error // 子连接被中止的原因，在done关闭前设置
+}
+
+func newStream(s *Session, id uint16, network byte, t utils.AddrType, addrData []byte, port uint16) *Stream {
+	return &Stream{
+		sess:     s,
+		id:       id,
+		network:  network,
+		addrType: t,
+		addrData: addrData,
+		port:     port,
+		rch:      make(chan []byte, streamBufferFrames),
+		eof:      make(chan struct{}),
+		rdead:    makeDeadline(),
+		wdead:    makeDeadline(),
+		wclosed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (st *Stream) ID() uint16    { return st.id }
+func (st *Stream) Network() byte { return st.network }
+
+func (st *Stream) Target() (utils.AddrType, []byte, uint16) {
+	return st.addrType, st.addrData, st.port
+}
+
+func (st *Stream) TargetString() (string, error) {
+	return utils.AddrString(st.addrType, st.addrData, st.port)
+}
+
+// 由会话的读循环调用，投递对端发来的数据
+func (st *Stream) push(data []byte) {
+	if st.network == NetworkUDP {
+		// 缓冲已满时直接丢弃，与UDP的语义保持一致，避免阻塞其它子连接
+		select {
+		case st.rch <- data:
+		default:
+		}
+		return
+	}
+
+	// 与Xray一致，等待数据被读取，不丢弃字节流中的数据
+	select {
+	case st.rch <- data:
+	case <-st.done:
+	case <-st.sess.closed:
+	}
+}
+
+// 对端结束发送，已经投递的数据仍然可以被读取
+func (st *Stream) closeRead(err error) {
+	st.eofOnce.Do(func() {
+		st.rerr = err
+		close(st.eof)
+	})
+	if isClosedChan(st.wclosed) {
+		st.sess.detach(st)
+	}
+}
+
+// 发送End帧，两个方向都结束后子连接从会话中移除
+func (st *Stream) closeWrite(option byte) {
+	st.wcloseOnce.Do(func() {
+		close(st.wclosed)
+		st.sess.writeFrame(&Frame{SessionID: st.id, Status: StatusEnd, Option: option})
+	})
+	if isClosedChan(st.eof) {
+		st.sess.detach(st)
+	}
+}
+
+// 中止子连接，notify为true时通知对端出错关闭
+func (st *Stream) reset(err error, notify bool) {
+	st.doneOnce.Do(func() {
+		st.derr = err
+		close(st.done)
+		st.closeRead(err)
+		if notify {
+			st.closeWrite(OptionError)
+		} else {
+			st.wcloseOnce.Do(func() { close(st.wclosed) })
+		}
+		st.sess.detach(st)
+	})
+}
+
+func (st *Stream) closedErr() error {
+	if st.derr != nil {
+		return st.derr
+	}
+	return io.ErrClosedPipe
+}
+
+func (st *Stream) Read(buf []byte) (int, error) {
+	if len(st.rbuf) == 0 {
+		select {
+		case data := <-st.rch:
+			st.rbuf = data
+		case <-st.eof:
+			select {
+			case data := <-st.rch:
+				st.rbuf = data
+			default:
+				return 0, st.rerr
+			}
+		case <-st.done:
+			return 0, st.closedErr()
+		case <-st.rdead.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(buf, st.rbuf)
+	if st.network == NetworkUDP {
+		st.rbuf = nil // buf长度不足时，数据包超出的部分被丢弃
+	} else {
+		st.rbuf = st.rbuf[n:]
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(buf []byte) (int, error) {
+	if isClosedChan(st.done) {
+		return 0, st.closedErr()
+	}
+	if isClosedChan(st.wclosed) {
+		return 0, io.ErrClosedPipe
+	}
+
+	if st.network == NetworkUDP {
+		if len(buf) > 0xFFFF {
+			return 0, ErrPacketTooLarge
+		}
+		err := st.sess.writeFrameDeadline(&Frame{SessionID: st.id, Status: StatusKeep, Option: OptionData, Data: buf}, st.wdead.wait())
+		if err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+
+	written := 0
+	for len(buf) > 0 {
+		p := buf
+		if len(p) > MaxFrameDataSize {
+			p = p[:MaxFrameDataSize]
+		}
+		err := st.sess.writeFrameDeadline(&Frame{SessionID: st.id, Status: StatusKeep, Option: OptionData, Data: p}, st.wdead.wait())
+		if err != nil {
+			return written, err
+		}
+		written += len(p)
+		buf = buf[len(p):]
+	}
+	return written, nil
+}
+
+func (st *Stream) Close() error {
+	st.doneOnce.Do(func() {
+		close(st.done)
+		st.closeWrite(0)
+		st.sess.detach(st)
+	})
+	return nil
+}
+
+// 结束发送方向，对端读取到io.EOF，仍然可以继续读取对端的数据
+func (st *Stream) CloseWrite() error {
+	if isClosedChan(st.done) {
+		return st.closedErr()
+	}
+	st.closeWrite(0)
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.rdead.set(t)
+	st.wdead.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.rdead.set(t)
+	return nil
+}
+
+// 超时只影响等待会话写入的过程，已经开始写入底层连接的帧不会被中断
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.wdead.set(t)
+	return nil
+}
@@ -116,3 +116,17 @@ func AddrString(t AddrType, addrData []byte, port uint16) (string, error) {
 		return "", ErrInvalidAddrType
 	}
 }
+
+// 代理目标地址，实现net.Addr接口
+// 目标可能是尚未解析的域名，所以仅保存字符串形式
+type Addr struct {
+	network string
+	address string
+}
+
+func NewAddr(network, address string) *Addr {
+	return &Addr{network: network, address: address}
+}
+
+func (a *Addr) Network() string { return a.network }
+func (a *Addr) String() string  { return a.address }
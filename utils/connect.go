@@ -1,28 +1,105 @@
 package utils
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
-
-	"golang.org/x/net/websocket"
 )
 
 type Dialer func() (net.Conn, error)
 
+// 连接服务端的配置
+type DialConfig struct {
+	Network string // tcp/ws/wss/h2/grpc
+	Address string
+	Port    uint16
+	Path    string      // ws的请求路径
+	TLS     *TLSConfig  // 为nil时不使用TLS，network为wss时使用默认配置
+	WS      *WSConfig   // network为ws/wss时有效，为nil时使用默认配置
+	H2      *H2Config   // network为h2时有效，没有设置TLS时使用h2c
+	GRPC    *GRPCConfig // network为grpc时有效，没有设置TLS时使用h2c
+}
+
+// 去掉地址中的端口
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
 func MakeDialer(network, address string, port uint16, path string) (Dialer, error) {
+	return MakeDialerWithConfig(&DialConfig{
+		Network: network,
+		Address: address,
+		Port:    port,
+		Path:    path,
+	})
+}
+
+func MakeDialerWithConfig(cfg *DialConfig) (Dialer, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tlsConfig, err = cfg.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	target := ""
-	switch network {
+	switch cfg.Network {
 	case "tcp":
-		target = fmt.Sprintf("%v:%v", address, port)
+		target = fmt.Sprintf("%v:%v", cfg.Address, cfg.Port)
+		if tlsConfig != nil {
+			return func() (net.Conn, error) {
+				return tls.Dial("tcp", target, tlsConfig)
+			}, nil
+		}
 		return func() (net.Conn, error) {
 			return net.Dial("tcp", target)
 		}, nil
-	case "ws":
-		target = fmt.Sprintf("ws://%v:%v%v", address, port, path)
+	case "ws", "wss":
+		scheme := "ws"
+		if cfg.Network == "wss" && tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig != nil {
+			scheme = "wss"
+			// 没有指定SNI时使用Host请求头中的域名
+			if tlsConfig.ServerName == "" && cfg.WS != nil && cfg.WS.Host != "" {
+				tlsConfig.ServerName = hostname(cfg.WS.Host)
+			}
+		}
+		wsDialer, err := newWSDialer(cfg.WS, scheme, cfg.Address, cfg.Port, cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		target = fmt.Sprintf("%v:%v", cfg.Address, cfg.Port)
 		return func() (net.Conn, error) {
-			return websocket.Dial(target, "", "http://qq.com/")
+			var raw net.Conn
+			var err error
+			if tlsConfig != nil {
+				raw, err = tls.Dial("tcp", target, tlsConfig)
+			} else {
+				raw, err = net.Dial("tcp", target)
+			}
+			if err != nil {
+				return nil, err
+			}
+			c, err := wsDialer.upgrade(raw)
+			if err != nil {
+				raw.Close()
+				return nil, err
+			}
+			return c, nil
 		}, nil
+	case "h2":
+		return makeH2Dialer(cfg, tlsConfig)
+	case "grpc":
+		return makeGRPCDialer(cfg, tlsConfig)
 	default:
 		return nil, errors.New("invalid network")
 	}
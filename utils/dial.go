@@ -12,3 +12,13 @@ func Dial(addr string) (net.Conn, error) {
 	}
 	return c, nil
 }
+
+// 创建UDP出口，每次调用都会使用独立的本地端口，
+// 并且只接受来自目标地址的回包，相当于一条NAT映射
+func DialUDP(addr string) (net.Conn, error) {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial udp '%v' failed, err=%v", addr, err)
+	}
+	return c, nil
+}
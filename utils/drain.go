@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// 服务端握手（认证与读取指令）默认的超时时间
+const DefaultHandshakeTimeout = time.Second * 4
+
+// 握手失败时丢弃的数据长度范围
+const (
+	minDrainSize = 16
+	maxDrainSize = 4096
+)
+
+// 握手失败后继续读取并丢弃随机长度的数据，再由调用方关闭连接
+// 避免探测者根据服务端关闭连接的时机识别协议
+// 读取受连接已有的deadline限制，调用前需要设置deadline
+func DrainConn(c net.Conn) {
+	var b [2]byte
+	rand.Read(b[:])
+	n := minDrainSize + int64(binary.BigEndian.Uint16(b[:]))%(maxDrainSize-minDrainSize)
+	io.CopyN(io.Discard, c, n)
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 握手失败的类型，可以通过errors.Is判断
+var (
+	ErrAuthRejected     = errors.New("auth rejected")     // 服务端没有应答就关闭了连接
+	ErrResponseMismatch = errors.New("response mismatch") // 应答无法解析或与请求不匹配
+	ErrTransport        = errors.New("transport failure") // 底层连接读写失败
+)
+
+// 客户端握手阶段的错误
+// 发生后连接不再可用，后续的Read/Write都返回同一个错误
+type HandshakeError struct {
+	Kind error
+	Err  error
+}
+
+func NewHandshakeError(kind, err error) *HandshakeError {
+	return &HandshakeError{Kind: kind, Err: err}
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *HandshakeError) Is(target error) bool { return target == e.Kind }
+func (e *HandshakeError) Unwrap() error        { return e.Err }
+
+// 读取应答失败时的错误分类
+// 服务端认证失败时会直接关闭连接，所以一个字节都没有读到时视为认证被拒绝
+func NewResponseReadError(err error) *HandshakeError {
+	if errors.Is(err, io.EOF) {
+		return NewHandshakeError(ErrAuthRejected, err)
+	}
+	return NewHandshakeError(ErrTransport, err)
+}
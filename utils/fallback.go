@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+)
+
+// 认证失败时的回落目标，可以按首包特征选择
+type Fallback struct {
+	Path string `json:"path"` // HTTP请求路径，空表示不限制
+	ALPN string `json:"alpn"` // TLS协商的应用层协议，空表示不限制
+	Dest string `json:"dest"` // 回落目标地址，例如127.0.0.1:80
+}
+
+type Fallbacks []*Fallback
+
+// 选择与首包匹配的回落目标，没有匹配时返回nil
+// 多个目标都匹配时优先选择条件更多的，条件数量相同时按配置顺序
+func (fbs Fallbacks) Match(alpn string, firstPacket []byte) *Fallback {
+	path := parseHTTPPath(firstPacket)
+
+	var found *Fallback
+	best := -1
+	for _, fb := range fbs {
+		score := 0
+		if fb.ALPN != "" {
+			if fb.ALPN != alpn {
+				continue
+			}
+			score++
+		}
+		if fb.Path != "" {
+			if fb.Path != path {
+				continue
+			}
+			score++
+		}
+		if score > best {
+			found, best = fb, score
+		}
+	}
+	return found
+}
+
+func (fbs Fallbacks) hasPath() bool {
+	for _, fb := range fbs {
+		if fb.Path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 将认证失败的连接转发到匹配的回落目标，包括认证阶段已经读取的数据
+// 没有匹配的目标时返回false，由调用方继续处理
+func (fbs Fallbacks) Serve(pc *PeekConn, idle time.Duration) (bool, error) {
+	// 认证阶段可能只读取了请求行的一部分
+	if fbs.hasPath() && !bytes.Contains(pc.Bytes(), []byte("\r\n")) {
+		pc.Fill()
+	}
+
+	fb := fbs.Match(ConnALPN(pc), pc.Bytes())
+	if fb == nil {
+		return false, nil
+	}
+
+	pc.SetDeadline(time.Time{})
+	pc.Rewind()
+
+	target, err := Dial(fb.Dest)
+	if err != nil {
+		return true, err
+	}
+	defer target.Close()
+
+	log.Printf("fallback. remote='%v' dest='%v'\n", pc.RemoteAddr(), fb.Dest)
+	LinkAndLog(fb.Dest, target, pc, idle)
+	return true, nil
+}
+
+// 读取HTTP请求行中的路径，不是HTTP请求时返回空字符串
+func parseHTTPPath(buf []byte) string {
+	line, _, ok := bytes.Cut(buf, []byte("\r\n"))
+	if !ok {
+		return ""
+	}
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || !bytes.HasPrefix(fields[2], []byte("HTTP/")) || !bytes.HasPrefix(fields[1], []byte("/")) {
+		return ""
+	}
+	return string(fields[1])
+}
+
+// TLS连接协商的应用层协议，不是TLS连接时返回空字符串
+// PeekConn会被逐层展开，例如demux交给vless/vmess处理的连接
+func ConnALPN(c net.Conn) string {
+	for {
+		pc, ok := c.(*PeekConn)
+		if !ok {
+			break
+		}
+		c = pc.Conn
+	}
+	if tc, ok := c.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tc.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbacksMatch(t *testing.T) {
+	def := &Fallback{Dest: "127.0.0.1:80"}
+	ws := &Fallback{Path: "/ws", Dest: "127.0.0.1:81"}
+	h2 := &Fallback{ALPN: "h2", Dest: "127.0.0.1:82"}
+	h2ws := &Fallback{ALPN: "h2", Path: "/ws", Dest: "127.0.0.1:83"}
+	fbs := Fallbacks{def, ws, h2, h2ws}
+
+	tests := []struct {
+		name  string
+		alpn  string
+		first string
+		want  *Fallback
+	}{
+		{"default", "", "\x01\x02\x03", def},
+		{"path", "", "GET /ws HTTP/1.1\r\nHost: a\r\n\r\n", ws},
+		{"path not match", "", "GET /other HTTP/1.1\r\n\r\n", def},
+		{"incomplete line", "", "GET /ws HTT", def},
+		{"alpn", "h2", "PRI * HTTP/2.0\r\n", h2},
+		{"alpn and path", "h2", "GET /ws HTTP/1.1\r\n\r\n", h2ws},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, fbs.Match(tt.alpn, []byte(tt.first)))
+		})
+	}
+
+	assert.Nil(t, Fallbacks{ws}.Match("", []byte("GET / HTTP/1.1\r\n")))
+	assert.Nil(t, Fallbacks(nil).Match("", nil))
+}
+
+type alpnConn struct {
+	net.Conn
+	alpn string
+}
+
+func (c *alpnConn) ConnectionState() tls.ConnectionState {
+	return tls.ConnectionState{NegotiatedProtocol: c.alpn}
+}
+
+func TestConnALPN(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := &alpnConn{Conn: c1, alpn: "h2"}
+	assert.Equal(t, "h2", ConnALPN(c))
+	assert.Equal(t, "h2", ConnALPN(NewPeekConn(NewPeekConn(c, nil), nil)))
+	assert.Equal(t, "", ConnALPN(NewPeekConn(c1, nil)))
+}
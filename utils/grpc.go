@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 与V2Ray/Xray的grpc传输（gun）兼容，每条连接是GunService的一个双向流
+// Tun方法使用Hunk消息，TunMulti方法使用MultiHunk消息：
+//
+//	message Hunk { bytes data = 1; }
+//	message MultiHunk { repeated bytes data = 1; }
+const (
+	DefaultGRPCServiceName = "GunService"
+	grpcContentType        = "application/grpc"
+	maxGunMessageSize      = 4 << 20 // 与grpc-go默认的最大接收消息一致
+)
+
+var (
+	errGunCompressed   = errors.New("gun compressed message not supported")
+	errGunMessageSize  = errors.New("gun message too large")
+	errGunInvalidField = errors.New("gun invalid message field")
+)
+
+// gRPC客户端配置
+type GRPCConfig struct {
+	ServiceName string `json:"serviceName"` // 为空时使用DefaultGRPCServiceName
+	MultiMode   bool   `json:"multiMode"`   // 使用TunMulti方法
+	Host        string `json:"host"`        // :authority，为空时使用连接地址
+}
+
+// 合并客户端配置中的host、path字段（与v2rayN的分享格式一致，path为serviceName）与settings，settings优先
+func ParseGRPC(host, path string, settings *GRPCConfig) *GRPCConfig {
+	grpc := &GRPCConfig{}
+	if settings != nil {
+		*grpc = *settings
+	}
+	if grpc.Host == "" {
+		grpc.Host = host
+	}
+	if grpc.ServiceName == "" {
+		grpc.ServiceName = path
+	}
+	return grpc
+}
+
+// serviceName两端的"/"会被去掉，例如"/"等同于空
+func gunPath(serviceName, method string) string {
+	serviceName = strings.Trim(serviceName, "/")
+	if serviceName == "" {
+		serviceName = DefaultGRPCServiceName
+	}
+	return "/" + url.PathEscape(serviceName) + "/" + method
+}
+
+// tlsConfig为nil时使用h2c
+func makeGRPCDialer(cfg *DialConfig, tlsConfig *tls.Config) (Dialer, error) {
+	grpc := cfg.GRPC
+	if grpc == nil {
+		grpc = &GRPCConfig{}
+	}
+	method := "Tun"
+	if grpc.MultiMode {
+		method = "TunMulti"
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", grpcContentType)
+	header.Set("Te", "trailers")
+	client := newH2Client(cfg, tlsConfig, grpc.Host, gunPath(grpc.ServiceName, method), header)
+	client.wrap = wrapGun
+	return func() (net.Conn, error) {
+		c, err := client.dial()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}, nil
+}
+
+// gRPC服务端配置
+type GRPCServerConfig struct {
+	ServiceName string `json:"serviceName"` // 为空时使用DefaultGRPCServiceName，同时接受Tun与TunMulti
+	Host        string `json:"host"`        // 不为空时校验:authority
+}
+
+func newGRPCListener(l net.Listener, cfg *GRPCServerConfig) *h2Listener {
+	config := GRPCServerConfig{}
+	if cfg != nil {
+		config = *cfg
+	}
+	tun := gunPath(config.ServiceName, "Tun")
+	tunMulti := gunPath(config.ServiceName, "TunMulti")
+
+	hl := newH2StreamListener(l, func(r *http.Request) bool {
+		if r.URL.Path != tun && r.URL.Path != tunMulti {
+			return false
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType) {
+			return false
+		}
+		return config.Host == "" || hostname(r.Host) == hostname(config.Host)
+	})
+	hl.wrap = wrapGun
+	hl.header = http.Header{"Content-Type": {grpcContentType}}
+	hl.trailer = http.Header{"Grpc-Status": {"0"}}
+	hl.start()
+	return hl
+}
+
+func wrapGun(c *h2Conn) {
+	c.reader = &gunReader{r: c.reader}
+	c.writer = &gunWriter{w: c.writer}
+}
+
+// 读取gRPC消息，依次返回消息中的data字段，兼容Hunk与MultiHunk
+type gunReader struct {
+	r    io.Reader
+	msg  []byte // 当前消息中未解析的部分
+	data []byte // 当前data字段中未读取的部分
+}
+
+func (gr *gunReader) Read(buf []byte) (int, error) {
+	for len(gr.data) == 0 {
+		if len(gr.msg) == 0 {
+			if err := gr.readMessage(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := gr.nextField(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, gr.data)
+	gr.data = gr.data[n:]
+	return n, nil
+}
+
+// 消息格式：1字节压缩标志，4字节大端长度，protobuf编码的消息
+func (gr *gunReader) readMessage() error {
+	var header [5]byte
+	if _, err := io.ReadFull(gr.r, header[:]); err != nil {
+		return err
+	}
+	if header[0] != 0 {
+		return errGunCompressed
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxGunMessageSize {
+		return errGunMessageSize
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(gr.r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	gr.msg = msg
+	return nil
+}
+
+// 解析一个字段，data字段放入gr.data，其它字段跳过
+func (gr *gunReader) nextField() error {
+	tag, n := binary.Uvarint(gr.msg)
+	if n <= 0 {
+		return errGunInvalidField
+	}
+	msg := gr.msg[n:]
+
+	var size uint64
+	switch tag & 7 {
+	case 0: // varint
+		if _, n = binary.Uvarint(msg); n <= 0 {
+			return errGunInvalidField
+		}
+		size = uint64(n)
+	case 1: // fixed64
+		size = 8
+	case 2: // length-delimited
+		l, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errGunInvalidField
+		}
+		msg = msg[n:]
+		size = l
+	case 5: // fixed32
+		size = 4
+	default:
+		return fmt.Errorf("gun unsupported wire type=%v", tag&7)
+	}
+	if size > uint64(len(msg)) {
+		return errGunInvalidField
+	}
+
+	if tag == 1<<3|2 {
+		gr.data = msg[:size]
+	}
+	gr.msg = msg[size:]
+	return nil
+}
+
+// 每次写入编码为一个只有一个data字段的消息，Hunk与MultiHunk的编码相同
+type gunWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (gw *gunWriter) Write(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	var field [binary.MaxVarintLen64 + 1]byte
+	field[0] = 1<<3 | 2
+	fieldLen := 1 + binary.PutUvarint(field[1:], uint64(len(buf)))
+
+	msg := make([]byte, 5, 5+fieldLen+len(buf))
+	binary.BigEndian.PutUint32(msg[1:], uint32(fieldLen+len(buf)))
+	msg = append(msg, field[:fieldLen]...)
+	msg = append(msg, buf...)
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if _, err := gw.w.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (gw *gunWriter) Close() error {
+	if closer, ok := gw.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return errors.New("close write not supported")
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGunFraming(t *testing.T) {
+	// Hunk{data: "abc"}
+	buf := &bytes.Buffer{}
+	n, err := (&gunWriter{w: buf}).Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []byte{0, 0, 0, 0, 5, 0x0a, 3, 'a', 'b', 'c'}, buf.Bytes())
+
+	// MultiHunk{data: ["hello", "", "world"]}，中间带一个未知的varint字段
+	msg := []byte{0x0a, 5, 'h', 'e', 'l', 'l', 'o', 0x0a, 0, 0x10, 0x96, 0x01, 0x0a, 5, 'w', 'o', 'r', 'l', 'd'}
+	buf.Write([]byte{0, 0, 0, 0, byte(len(msg))})
+	buf.Write(msg)
+
+	data, err := io.ReadAll(&gunReader{r: buf})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abchelloworld"), data)
+
+	// 压缩的消息与截断的消息
+	_, err = (&gunReader{r: bytes.NewReader([]byte{1, 0, 0, 0, 0})}).Read(make([]byte, 8))
+	assert.Equal(t, errGunCompressed, err)
+	_, err = (&gunReader{r: bytes.NewReader([]byte{0, 0, 0, 0, 5, 0x0a, 3})}).Read(make([]byte, 8))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = (&gunReader{r: bytes.NewReader([]byte{0, 0, 0, 0, 2, 0x0a, 3})}).Read(make([]byte, 8))
+	assert.Equal(t, errGunInvalidField, err)
+}
+
+func TestGunPath(t *testing.T) {
+	assert.Equal(t, "/GunService/Tun", gunPath("", "Tun"))
+	assert.Equal(t, "/GunService/TunMulti", gunPath("/", "TunMulti"))
+	assert.Equal(t, "/my%20service/Tun", gunPath("my service", "Tun"))
+}
+
+func TestGRPC(t *testing.T) {
+	dir := t.TempDir()
+	serverTLS := &TLSServerConfig{Certificates: []CertFile{writeCertFile(t, dir, "example.com")}}
+	tests := []struct {
+		name      string
+		serverTLS *TLSServerConfig
+		clientTLS *TLSConfig
+		multi     bool
+	}{
+		{"h2c-tun", nil, nil, false},
+		{"h2c-multi", nil, nil, true},
+		{"tls-tun", serverTLS, &TLSConfig{Insecure: true}, false},
+		{"tls-multi", serverTLS, &TLSConfig{Insecure: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := MakeListener(&ListenConfig{
+				Network: "grpc",
+				Address: "127.0.0.1",
+				TLS:     tt.serverTLS,
+				GRPC:    &GRPCServerConfig{ServiceName: "tunnel", Host: "cdn.example.com"},
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer l.Close()
+
+			// 读取完所有数据后才返回应答，验证半关闭
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						buf, _ := io.ReadAll(c)
+						c.Write(buf)
+						c.Close()
+					}()
+				}
+			}()
+
+			port := uint16(l.Addr().(*net.TCPAddr).Port)
+			makeDial := func(serviceName string) Dialer {
+				dial, err := MakeDialerWithConfig(&DialConfig{
+					Network: "grpc",
+					Address: "127.0.0.1",
+					Port:    port,
+					TLS:     tt.clientTLS,
+					GRPC:    ParseGRPC("cdn.example.com", "", &GRPCConfig{ServiceName: serviceName, MultiMode: tt.multi}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return dial
+			}
+
+			_, err = makeDial("other")()
+			assert.NotNil(t, err)
+
+			c, err := makeDial("tunnel")()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c.Close()
+
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+			payload := bytes.Repeat([]byte{1, 2, 3}, 20000)
+			c.Write(payload[:10])
+			c.Write(payload[10:])
+			assert.Nil(t, c.(interface{ CloseWrite() error }).CloseWrite())
+			resp, err := io.ReadAll(c)
+			assert.Nil(t, err)
+			assert.Equal(t, payload, resp)
+		})
+	}
+}
+
+// 另一个方向还在写入时关闭服务端的连接
+func TestGRPCServerWriteAfterClose(t *testing.T) {
+	l, err := MakeListener(&ListenConfig{Network: "grpc", Address: "127.0.0.1"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				if _, err := c.Write(buf); err != nil {
+					writeErr <- err
+					return
+				}
+			}
+		}()
+		time.Sleep(time.Millisecond * 50)
+		c.Close()
+	}()
+
+	dial, err := MakeDialerWithConfig(&DialConfig{
+		Network: "grpc",
+		Address: "127.0.0.1",
+		Port:    uint16(l.Addr().(*net.TCPAddr).Port),
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	c, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	io.Copy(io.Discard, c)
+
+	select {
+	case err := <-writeErr:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("write not stopped")
+	}
+}
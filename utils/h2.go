@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP/2客户端配置，每条连接是共享TCP连接上的一个POST请求
+type H2Config struct {
+	Host    string            `json:"host"`    // Host请求头，为空时使用连接地址
+	Headers map[string]string `json:"headers"` // 额外的请求头
+}
+
+// 合并客户端配置中的host字段与settings，settings中的Host优先
+func ParseH2(host string, settings *H2Config) *H2Config {
+	if host == "" {
+		return settings
+	}
+	h2 := &H2Config{}
+	if settings != nil {
+		*h2 = *settings
+	}
+	if h2.Host == "" {
+		h2.Host = host
+	}
+	return h2
+}
+
+// tlsConfig为nil时使用h2c（明文HTTP/2）
+func makeH2Dialer(cfg *DialConfig, tlsConfig *tls.Config) (Dialer, error) {
+	h2 := cfg.H2
+	if h2 == nil {
+		h2 = &H2Config{}
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/"
+	}
+
+	header := http.Header{}
+	for k, v := range h2.Headers {
+		header.Set(k, v)
+	}
+	client := newH2Client(cfg, tlsConfig, h2.Host, path, header)
+	return func() (net.Conn, error) {
+		c, err := client.dial()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}, nil
+}
+
+// 在共享的HTTP/2连接上为每条连接发起一个POST请求
+type h2Client struct {
+	transport *http2.Transport
+	url       string
+	header    http.Header
+	wrap      func(c *h2Conn) // 为nil时直接使用请求体与应答体
+}
+
+func newH2Client(cfg *DialConfig, tlsConfig *tls.Config, host, path string, header http.Header) *h2Client {
+	target := fmt.Sprintf("%v:%v", cfg.Address, cfg.Port)
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		tlsConfig.NextProtos = append([]string{http2.NextProtoTLS}, tlsConfig.NextProtos...)
+		if tlsConfig.ServerName == "" && host != "" {
+			tlsConfig.ServerName = hostname(host)
+		}
+	}
+	if host == "" {
+		host = target
+	}
+
+	// 所有连接共用一个Transport，复用底层的TCP连接
+	transport := &http2.Transport{
+		AllowHTTP: tlsConfig == nil,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			if tlsConfig == nil {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", target)
+			}
+			d := tls.Dialer{Config: tlsConfig}
+			return d.DialContext(ctx, "tcp", target)
+		},
+	}
+
+	return &h2Client{
+		transport: transport,
+		url:       fmt.Sprintf("%v://%v%v", scheme, host, path),
+		header:    header,
+	}
+}
+
+// 等待服务端返回应答头部后返回连接
+func (hc *h2Client) dial() (*h2Conn, error) {
+	pr, pw := io.Pipe()
+	c := newH2Conn()
+	c.writer = pw
+
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		c.local, c.remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+	}}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodPost, hc.url, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = hc.header.Clone()
+
+	resp, err := hc.transport.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("h2 request failed, status='%v'", resp.Status)
+	}
+	c.reader = resp.Body
+	c.closers = []io.Closer{pw, resp.Body}
+	if hc.wrap != nil {
+		hc.wrap(c)
+	}
+	return c, nil
+}
+
+// HTTP/2服务端配置
+type H2ServerConfig struct {
+	Path string `json:"path"` // 请求路径，为空时使用"/"，不匹配时返回404
+	Host string `json:"host"` // 不为空时校验Host请求头
+}
+
+// tls的ALPN在MakeListener中设置，没有TLS时使用h2c（prior knowledge）
+func newH2Listener(l net.Listener, cfg *H2ServerConfig) *h2Listener {
+	config := H2ServerConfig{}
+	if cfg != nil {
+		config = *cfg
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+
+	hl := newH2StreamListener(l, func(r *http.Request) bool {
+		return r.URL.Path == config.Path && (config.Host == "" || hostname(r.Host) == hostname(config.Host))
+	})
+	hl.start()
+	return hl
+}
+
+var errH2ConnClosed = errors.New("h2 conn closed")
+
+// 后台读取时每次读取的最大长度
+const h2ReadSize = 16 << 10
+
+// HTTP/2流上的连接，请求体与应答体分别作为两个方向
+// 请求体与应答体本身不支持deadline，读写在后台的goroutine中进行，超时后返回os.ErrDeadlineExceeded，
+// 超时的写入仍会在后台完成，之后的写入等待它完成后才开始
+type h2Conn struct {
+	reader  io.Reader
+	writer  io.Writer
+	closers []io.Closer
+
+	local, remote net.Addr
+
+	readOnce sync.Once
+	rch      chan []byte // 后台读取到的数据，读取出错后关闭
+	rerr     error       // rch关闭前设置
+	rbuf     []byte
+	rdead    deadline
+
+	writeOnce sync.Once
+	wmu       sync.Mutex
+	wch       chan []byte
+	wres      chan error
+	wpending  bool // 上一次写入超时后还没有完成
+	wdead     deadline
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newH2Conn() *h2Conn {
+	return &h2Conn{
+		rch:   make(chan []byte),
+		rdead: makeDeadline(),
+		wch:   make(chan []byte),
+		wres:  make(chan error, 1),
+		wdead: makeDeadline(),
+		done:  make(chan struct{}),
+	}
+}
+
+func (c *h2Conn) readLoop() {
+	for {
+		buf := make([]byte, h2ReadSize)
+		n, err := c.reader.Read(buf)
+		if n > 0 {
+			select {
+			case c.rch <- buf[:n]:
+			case <-c.done:
+				return
+			}
+		}
+		if err != nil {
+			c.rerr = err
+			close(c.rch)
+			return
+		}
+	}
+}
+
+func (c *h2Conn) Read(buf []byte) (int, error) {
+	c.readOnce.Do(func() { go c.readLoop() })
+
+	if len(c.rbuf) == 0 {
+		select {
+		case data, ok := <-c.rch:
+			if !ok {
+				return 0, c.rerr
+			}
+			c.rbuf = data
+		case <-c.rdead.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, errH2ConnClosed
+		}
+	}
+	n := copy(buf, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *h2Conn) writeLoop() {
+	for {
+		select {
+		case buf := <-c.wch:
+			_, err := c.writer.Write(buf)
+			c.wres <- err
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 关闭后的写入直接返回错误，服务端的流在关闭后也不会再发送数据
+func (c *h2Conn) Write(buf []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.writeOnce.Do(func() { go c.writeLoop() })
+
+	if err := c.waitWrite(); err != nil {
+		return 0, err
+	}
+	if isClosedChan(c.done) {
+		return 0, errH2ConnClosed
+	}
+
+	// 超时返回后后台仍在写入，不能继续使用调用方的buf
+	select {
+	case c.wch <- append([]byte(nil), buf...):
+	case <-c.wdead.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, errH2ConnClosed
+	}
+	c.wpending = true
+	if err := c.waitWrite(); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// 等待后台正在进行的写入，调用时需要持有wmu
+func (c *h2Conn) waitWrite() error {
+	if !c.wpending {
+		return nil
+	}
+	select {
+	case err := <-c.wres:
+		c.wpending = false
+		return err
+	case <-c.wdead.wait():
+		return os.ErrDeadlineExceeded
+	case <-c.done:
+		return errH2ConnClosed
+	}
+}
+
+func (c *h2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		for _, closer := range c.closers {
+			closer.Close()
+		}
+	})
+	return nil
+}
+
+// 关闭写方向，对端读取到io.EOF，已经写入的数据先发送完毕
+func (c *h2Conn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.waitWrite(); err != nil {
+		return err
+	}
+	if closer, ok := c.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return errors.New("close write not supported")
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return c.local }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.rdead.set(t)
+	c.wdead.set(t)
+	return nil
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	c.rdead.set(t)
+	return nil
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	c.wdead.set(t)
+	return nil
+}
@@ -0,0 +1,760 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// net/http的处理函数返回前无法结束应答，返回后又会重置请求，不能半关闭
+// 这里直接处理HTTP/2的帧，只支持双向流形式的POST请求
+const (
+	h2StreamWindow    = 1 << 20 // 每个流的接收窗口，也是每个流最多缓存的数据量
+	h2ConnWindow      = 1 << 20 // 连接的接收窗口，收到数据后立即恢复
+	h2MaxStreams      = 256     // 每个连接上应用还没有关闭的流的数量上限
+	h2MaxPending      = 64      // 每个监听上等待Accept的流的数量上限
+	h2IdleTimeout     = 5 * time.Minute
+	h2MaxHeaderList   = 64 << 10
+	h2DefaultWindow   = 65535
+	h2DefaultMaxFrame = 16384
+)
+
+var (
+	errH2StreamClosed = errors.New("h2 stream closed")
+	errH2StreamReset  = errors.New("h2 stream reset by peer")
+	errH2Preface      = errors.New("invalid h2 preface")
+)
+
+// 将HTTP/2请求转换为连接，match返回false时应答404
+type h2Listener struct {
+	net.Listener
+	match   func(r *http.Request) bool
+	wrap    func(c *h2Conn) // 为nil时直接使用请求体与应答体
+	header  http.Header     // 额外的应答头
+	trailer http.Header     // 结束应答时发送的trailer
+
+	conns     chan net.Conn // 容量为h2MaxPending，发送前需要先预留
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	sessions map[*h2ServerConn]struct{}
+	pending  int // 已经预留的等待Accept的流
+}
+
+func newH2StreamListener(l net.Listener, match func(r *http.Request) bool) *h2Listener {
+	return &h2Listener{
+		Listener: l,
+		match:    match,
+		conns:    make(chan net.Conn, h2MaxPending),
+		done:     make(chan struct{}),
+		sessions: make(map[*h2ServerConn]struct{}),
+	}
+}
+
+// 设置wrap等字段之后调用
+func (hl *h2Listener) start() {
+	go hl.serve()
+}
+
+func (hl *h2Listener) serve() {
+	var delay time.Duration
+	for {
+		c, err := hl.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				delay = nextAcceptDelay(delay)
+				log.Printf("accept failed: %v, retrying in %v\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			hl.Close()
+			return
+		}
+		delay = 0
+
+		sc := newH2ServerConn(hl, c)
+		if !hl.track(sc, true) {
+			c.Close()
+			return
+		}
+		go sc.serve()
+	}
+}
+
+func (hl *h2Listener) track(sc *h2ServerConn, add bool) bool {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if !add {
+		delete(hl.sessions, sc)
+		return true
+	}
+	select {
+	case <-hl.done:
+		return false
+	default:
+	}
+	hl.sessions[sc] = struct{}{}
+	return true
+}
+
+// 为新的流预留等待Accept的位置，已满或者已经关闭时返回false
+func (hl *h2Listener) reserve() bool {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if isClosedChan(hl.done) || hl.pending >= h2MaxPending {
+		return false
+	}
+	hl.pending++
+	return true
+}
+
+func (hl *h2Listener) unreserve() {
+	hl.mu.Lock()
+	hl.pending--
+	hl.mu.Unlock()
+}
+
+// 交给Accept，已经预留了位置所以不会阻塞；监听已经关闭时返回false
+func (hl *h2Listener) push(c net.Conn) bool {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if isClosedChan(hl.done) {
+		hl.pending--
+		return false
+	}
+	hl.conns <- c
+	return true
+}
+
+func (hl *h2Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-hl.conns:
+		hl.unreserve()
+		return c, nil
+	case <-hl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// 停止接受新的流，关闭等待Accept的流
+// 已经Accept的流可以继续使用，HTTP/2连接在其上所有的流关闭后才关闭
+func (hl *h2Listener) Close() error {
+	hl.closeOnce.Do(func() {
+		hl.mu.Lock()
+		close(hl.done)
+		sessions := hl.sessions
+		hl.sessions = nil
+		hl.mu.Unlock()
+
+		for {
+			select {
+			case c := <-hl.conns:
+				hl.unreserve()
+				c.Close()
+				continue
+			default:
+			}
+			break
+		}
+
+		for sc := range sessions {
+			sc.shutdown()
+		}
+	})
+	return hl.Listener.Close()
+}
+
+// 服务端的HTTP/2连接，一个goroutine读取帧，流的读写在各自的goroutine中进行
+// 锁的顺序：先wmu后mu
+type h2ServerConn struct {
+	hl     *h2Listener
+	conn   net.Conn
+	framer *http2.Framer
+
+	wmu  sync.Mutex // 保护framer的写入与henc
+	henc *hpack.Encoder
+	hbuf bytes.Buffer
+
+	mu            sync.Mutex
+	cond          *sync.Cond // 流的状态或发送窗口变化时唤醒
+	streams       map[uint32]*h2Stream
+	lastID        uint32
+	sendWindow    int32  // 连接的发送窗口
+	initialWindow int32  // 对端设置的流初始发送窗口
+	maxFrameSize  uint32 // 对端允许的最大帧长度
+	closed        bool
+	active        int         // 应用还没有关闭的流，包括等待Accept的流
+	goingAway     bool        // 已经发送GOAWAY，不再接受新的流
+	idle          *time.Timer // 没有活跃的流超过h2IdleTimeout后关闭连接
+}
+
+func newH2ServerConn(hl *h2Listener, c net.Conn) *h2ServerConn {
+	sc := &h2ServerConn{
+		hl:            hl,
+		conn:          c,
+		framer:        http2.NewFramer(c, c),
+		streams:       make(map[uint32]*h2Stream),
+		sendWindow:    h2DefaultWindow,
+		initialWindow: h2DefaultWindow,
+		maxFrameSize:  h2DefaultMaxFrame,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.henc = hpack.NewEncoder(&sc.hbuf)
+	sc.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	sc.framer.MaxHeaderListSize = h2MaxHeaderList
+	return sc
+}
+
+func (sc *h2ServerConn) serve() {
+	defer sc.hl.track(sc, false)
+	defer sc.close()
+
+	err := sc.handshake()
+	for err == nil {
+		err = sc.processFrame()
+	}
+	if ce, ok := err.(http2.ConnectionError); ok {
+		sc.write(func(fr *http2.Framer) error {
+			return fr.WriteGoAway(sc.lastStreamID(), http2.ErrCode(ce), nil)
+		})
+	}
+}
+
+// 读取客户端的preface并发送SETTINGS，超时后关闭连接
+func (sc *h2ServerConn) handshake() error {
+	sc.conn.SetReadDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(sc.conn, preface); err != nil {
+		return err
+	}
+	if string(preface) != http2.ClientPreface {
+		return errH2Preface
+	}
+	sc.conn.SetReadDeadline(time.Time{})
+
+	sc.mu.Lock()
+	sc.idle = time.AfterFunc(h2IdleTimeout, sc.closeIdle)
+	sc.mu.Unlock()
+
+	return sc.write(func(fr *http2.Framer) error {
+		err := fr.WriteSettings(
+			http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: h2MaxStreams},
+			http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2StreamWindow},
+			http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: h2MaxHeaderList},
+		)
+		if err != nil {
+			return err
+		}
+		return fr.WriteWindowUpdate(0, h2ConnWindow-h2DefaultWindow)
+	})
+}
+
+func (sc *h2ServerConn) processFrame() error {
+	f, err := sc.framer.ReadFrame()
+	if se, ok := err.(http2.StreamError); ok {
+		sc.resetStream(se.StreamID, errH2StreamReset)
+		return sc.writeReset(se.StreamID, se.Code)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch f := f.(type) {
+	case *http2.SettingsFrame:
+		return sc.processSettings(f)
+	case *http2.MetaHeadersFrame:
+		return sc.processHeaders(f)
+	case *http2.DataFrame:
+		return sc.processData(f)
+	case *http2.WindowUpdateFrame:
+		return sc.processWindowUpdate(f)
+	case *http2.RSTStreamFrame:
+		sc.resetStream(f.StreamID, errH2StreamReset)
+	case *http2.PingFrame:
+		if !f.IsAck() {
+			return sc.write(func(fr *http2.Framer) error { return fr.WritePing(true, f.Data) })
+		}
+	case *http2.PushPromiseFrame:
+		return http2.ConnectionError(http2.ErrCodeProtocol)
+	}
+	// GOAWAY之后对端不再创建新的流，已有的流继续使用，其它帧忽略
+	return nil
+}
+
+func (sc *h2ServerConn) processSettings(f *http2.SettingsFrame) error {
+	if f.IsAck() {
+		return nil
+	}
+	err := f.ForeachSetting(func(s http2.Setting) error {
+		if err := s.Valid(); err != nil {
+			return err
+		}
+		switch s.ID {
+		case http2.SettingInitialWindowSize:
+			sc.mu.Lock()
+			delta := int32(s.Val) - sc.initialWindow
+			sc.initialWindow = int32(s.Val)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		case http2.SettingMaxFrameSize:
+			sc.mu.Lock()
+			sc.maxFrameSize = s.Val
+			sc.mu.Unlock()
+		case http2.SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.henc.SetMaxDynamicTableSizeLimit(s.Val)
+			sc.wmu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return sc.write(func(fr *http2.Framer) error { return fr.WriteSettingsAck() })
+}
+
+func (sc *h2ServerConn) processHeaders(f *http2.MetaHeadersFrame) error {
+	id := f.StreamID
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		sc.mu.Unlock()
+		// 请求的trailer，必须结束请求
+		if !f.StreamEnded() {
+			return http2.ConnectionError(http2.ErrCodeProtocol)
+		}
+		sc.endStream(st)
+		return nil
+	}
+	if id%2 == 0 || id <= sc.lastID {
+		sc.mu.Unlock()
+		return http2.ConnectionError(http2.ErrCodeProtocol)
+	}
+	sc.lastID = id
+	refused := sc.goingAway || sc.active >= h2MaxStreams
+	sc.mu.Unlock()
+	if refused {
+		return sc.writeReset(id, http2.ErrCodeRefusedStream)
+	}
+
+	var err error
+	r := &http.Request{
+		Method:     f.PseudoValue("method"),
+		Host:       f.PseudoValue("authority"),
+		Header:     make(http.Header),
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+	}
+	for _, hf := range f.RegularFields() {
+		r.Header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+	if r.Host == "" {
+		r.Host = r.Header.Get("Host")
+	}
+	r.URL, err = url.ParseRequestURI(f.PseudoValue("path"))
+	if err != nil || r.Method != http.MethodPost || !sc.hl.match(r) {
+		return sc.write(func(fr *http2.Framer) error {
+			if err := sc.writeHeaders(id, true, "404", nil); err != nil {
+				return err
+			}
+			if !f.StreamEnded() {
+				return fr.WriteRSTStream(id, http2.ErrCodeNo)
+			}
+			return nil
+		})
+	}
+	// 应用没有及时Accept时拒绝新的流，不在内存中无限堆积
+	if !sc.hl.reserve() {
+		return sc.writeReset(id, http2.ErrCodeRefusedStream)
+	}
+	st := &h2Stream{sc: sc, id: id, recvWindow: h2StreamWindow, trailer: sc.hl.trailer}
+	sc.mu.Lock()
+	if sc.goingAway {
+		// 连接正在关闭
+		sc.mu.Unlock()
+		sc.hl.unreserve()
+		return sc.writeReset(id, http2.ErrCodeRefusedStream)
+	}
+	st.sendWindow = sc.initialWindow
+	sc.streams[id] = st
+	sc.active++
+	sc.idle.Stop()
+	sc.mu.Unlock()
+	if f.StreamEnded() {
+		sc.endStream(st)
+	}
+
+	// 立即返回应答头部，客户端收到后才会返回连接
+	err = sc.write(func(fr *http2.Framer) error { return sc.writeHeaders(id, false, "200", sc.hl.header) })
+	if err != nil {
+		sc.hl.unreserve()
+		return err
+	}
+
+	c := newH2Conn()
+	c.reader = st
+	c.writer = &h2StreamWriter{st}
+	c.closers = []io.Closer{st}
+	c.local, c.remote = sc.conn.LocalAddr(), sc.conn.RemoteAddr()
+	if sc.hl.wrap != nil {
+		sc.hl.wrap(c)
+	}
+	if !sc.hl.push(c) {
+		c.Close()
+	}
+	return nil
+}
+
+func (sc *h2ServerConn) processData(f *http2.DataFrame) error {
+	// 收到后立即恢复连接的接收窗口，每个流缓存的数据量由流的接收窗口限制
+	if f.Length > 0 {
+		err := sc.write(func(fr *http2.Framer) error { return fr.WriteWindowUpdate(0, f.Length) })
+		if err != nil {
+			return err
+		}
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.StreamID]
+	if st == nil || st.rdone {
+		// 已经关闭的流，丢弃数据
+		sc.mu.Unlock()
+		return nil
+	}
+	st.recvWindow -= int32(f.Length)
+	if st.recvWindow < 0 {
+		sc.mu.Unlock()
+		sc.resetStream(st.id, errH2StreamReset)
+		return sc.writeReset(st.id, http2.ErrCodeFlowControl)
+	}
+	st.buf.Write(f.Data())
+	// 填充的数据不会被读取，直接恢复窗口
+	pad := f.Length - uint32(len(f.Data()))
+	st.recvWindow += int32(pad)
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	if pad > 0 {
+		if err := sc.write(func(fr *http2.Framer) error { return fr.WriteWindowUpdate(st.id, pad) }); err != nil {
+			return err
+		}
+	}
+	if f.StreamEnded() {
+		sc.endStream(st)
+	}
+	return nil
+}
+
+func (sc *h2ServerConn) processWindowUpdate(f *http2.WindowUpdateFrame) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	window := &sc.sendWindow
+	if f.StreamID != 0 {
+		st := sc.streams[f.StreamID]
+		if st == nil {
+			return nil
+		}
+		window = &st.sendWindow
+	}
+	if int64(*window)+int64(f.Increment) > 1<<31-1 {
+		return http2.ConnectionError(http2.ErrCodeFlowControl)
+	}
+	*window += int32(f.Increment)
+	sc.cond.Broadcast()
+	return nil
+}
+
+// 对端结束请求，缓存的数据读取完后返回io.EOF
+func (sc *h2ServerConn) endStream(st *h2Stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.rdone = true
+	if st.rerr == nil {
+		st.rerr = io.EOF
+	}
+	sc.removeStream(st)
+	sc.cond.Broadcast()
+}
+
+// 流被重置，丢弃缓存的数据
+func (sc *h2ServerConn) resetStream(id uint32, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := sc.streams[id]
+	if st == nil {
+		return
+	}
+	st.rdone, st.wclosed = true, true
+	st.buf.Reset()
+	st.rerr = err
+	sc.removeStream(st)
+	sc.cond.Broadcast()
+}
+
+// 两个方向都结束后不再接收这个流的帧，调用时需要持有mu
+func (sc *h2ServerConn) removeStream(st *h2Stream) {
+	if st.rdone && st.wclosed {
+		delete(sc.streams, st.id)
+	}
+}
+
+// 应用关闭了流，没有活跃的流时开始计算空闲时间，正在关闭时直接关闭连接
+func (sc *h2ServerConn) release(st *h2Stream) {
+	sc.mu.Lock()
+	if st.released {
+		sc.mu.Unlock()
+		return
+	}
+	st.released = true
+	sc.active--
+	idle := sc.active == 0 && !sc.closed
+	if idle && !sc.goingAway {
+		sc.idle.Reset(h2IdleTimeout)
+	}
+	drained := idle && sc.goingAway
+	sc.mu.Unlock()
+
+	if drained {
+		sc.conn.Close()
+	}
+}
+
+// 空闲超时后关闭连接
+func (sc *h2ServerConn) closeIdle() {
+	sc.mu.Lock()
+	idle := sc.active == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.shutdown()
+	}
+}
+
+// 发送GOAWAY，不再接受新的流，已有的流都关闭后关闭连接
+func (sc *h2ServerConn) shutdown() {
+	sc.mu.Lock()
+	if sc.goingAway || sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	drained := sc.active == 0
+	sc.mu.Unlock()
+
+	sc.write(func(fr *http2.Framer) error {
+		return fr.WriteGoAway(sc.lastStreamID(), http2.ErrCodeNo, nil)
+	})
+	if drained {
+		sc.conn.Close()
+	}
+}
+
+func (sc *h2ServerConn) lastStreamID() uint32 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.lastID
+}
+
+// 关闭连接，所有的流读取完缓存的数据后返回io.ErrUnexpectedEOF
+func (sc *h2ServerConn) close() {
+	sc.conn.Close()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.closed = true
+	if sc.idle != nil {
+		sc.idle.Stop()
+	}
+	for _, st := range sc.streams {
+		st.rdone, st.wclosed = true, true
+		if st.rerr == nil {
+			st.rerr = io.ErrUnexpectedEOF
+		}
+	}
+	sc.streams = make(map[uint32]*h2Stream)
+	sc.cond.Broadcast()
+}
+
+func (sc *h2ServerConn) write(fn func(fr *http2.Framer) error) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return fn(sc.framer)
+}
+
+func (sc *h2ServerConn) writeReset(id uint32, code http2.ErrCode) error {
+	return sc.write(func(fr *http2.Framer) error { return fr.WriteRSTStream(id, code) })
+}
+
+// 头部较小，不拆分为CONTINUATION帧，调用时需要持有wmu
+func (sc *h2ServerConn) writeHeaders(id uint32, endStream bool, status string, header http.Header) error {
+	sc.hbuf.Reset()
+	if status != "" {
+		sc.henc.WriteField(hpack.HeaderField{Name: ":status", Value: status})
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			sc.henc.WriteField(hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	return sc.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: sc.hbuf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+// 服务端的流，请求体为读方向，应答体为写方向
+// 除了wmu，其它字段由sc.mu保护
+type h2Stream struct {
+	sc      *h2ServerConn
+	id      uint32
+	trailer http.Header
+
+	wmu sync.Mutex // 保证一次Write的数据连续
+
+	buf        bytes.Buffer // 收到但没有读取的数据
+	rerr       error        // buf读取完后返回的错误
+	rdone      bool         // 对端已经结束请求或重置流
+	recvWindow int32        // 对端剩余可以发送的数据量
+	consumed   uint32       // 已经读取但没有恢复窗口的数据量
+	sendWindow int32
+	wclosed    bool // 已经结束应答
+	released   bool // 应用已经关闭了流
+}
+
+func (st *h2Stream) Read(buf []byte) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	for st.buf.Len() == 0 && st.rerr == nil {
+		sc.cond.Wait()
+	}
+	if st.buf.Len() == 0 {
+		err := st.rerr
+		sc.mu.Unlock()
+		return 0, err
+	}
+	n, _ := st.buf.Read(buf)
+
+	// 读取后才恢复流的接收窗口，攒够一定数量再发送WINDOW_UPDATE
+	var incr uint32
+	st.consumed += uint32(n)
+	if !st.rdone && st.consumed >= h2StreamWindow/4 {
+		incr = st.consumed
+		st.consumed = 0
+		st.recvWindow += int32(incr)
+	}
+	sc.mu.Unlock()
+
+	if incr > 0 {
+		sc.write(func(fr *http2.Framer) error { return fr.WriteWindowUpdate(st.id, incr) })
+	}
+	return n, nil
+}
+
+func (st *h2Stream) Write(buf []byte) (int, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	sc := st.sc
+	written := 0
+	for len(buf) > 0 {
+		sc.mu.Lock()
+		for !st.wclosed && !sc.closed && (st.sendWindow <= 0 || sc.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.wclosed || sc.closed {
+			sc.mu.Unlock()
+			return written, errH2StreamClosed
+		}
+		n := int32(len(buf))
+		for _, limit := range []int32{st.sendWindow, sc.sendWindow, int32(sc.maxFrameSize)} {
+			if n > limit {
+				n = limit
+			}
+		}
+		st.sendWindow -= n
+		sc.sendWindow -= n
+		sc.mu.Unlock()
+
+		// 结束应答与写入数据都持有wmu，这里再检查一次，不会在END_STREAM之后发送数据
+		err := sc.write(func(fr *http2.Framer) error {
+			sc.mu.Lock()
+			closed := st.wclosed
+			sc.mu.Unlock()
+			if closed {
+				return errH2StreamClosed
+			}
+			return fr.WriteData(st.id, false, buf[:n])
+		})
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+// 结束应答，有trailer时在HEADERS帧中发送，请求体可以继续读取
+func (st *h2Stream) CloseWrite() error {
+	sc := st.sc
+	return sc.write(func(fr *http2.Framer) error {
+		sc.mu.Lock()
+		if st.wclosed {
+			sc.mu.Unlock()
+			return nil
+		}
+		st.wclosed = true
+		sc.removeStream(st)
+		sc.cond.Broadcast()
+		sc.mu.Unlock()
+
+		if len(st.trailer) > 0 {
+			return sc.writeHeaders(st.id, true, "", st.trailer)
+		}
+		return fr.WriteData(st.id, true, nil)
+	})
+}
+
+// 结束应答，对端还在发送请求时重置流，通知对端停止发送
+func (st *h2Stream) Close() error {
+	err := st.CloseWrite()
+
+	sc := st.sc
+	sc.release(st)
+	sc.mu.Lock()
+	reset := !st.rdone
+	st.rdone = true
+	st.buf.Reset()
+	st.rerr = errH2StreamClosed
+	sc.removeStream(st)
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	if reset && err == nil {
+		err = sc.writeReset(st.id, http2.ErrCodeNo)
+	}
+	return err
+}
+
+// 关闭时只结束应答，用于h2Conn.CloseWrite
+type h2StreamWriter struct {
+	st *h2Stream
+}
+
+func (w *h2StreamWriter) Write(buf []byte) (int, error) { return w.st.Write(buf) }
+func (w *h2StreamWriter) Close() error                  { return w.st.CloseWrite() }
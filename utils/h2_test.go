@@ -0,0 +1,289 @@
+package utils
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestH2(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		serverTLS *TLSServerConfig
+		clientTLS *TLSConfig
+	}{
+		{"h2c", nil, nil},
+		{"h2", &TLSServerConfig{Certificates: []CertFile{writeCertFile(t, dir, "example.com")}}, &TLSConfig{Insecure: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := MakeListener(&ListenConfig{
+				Network: "h2",
+				Address: "127.0.0.1",
+				TLS:     tt.serverTLS,
+				H2:      &H2ServerConfig{Path: "/tunnel", Host: "cdn.example.com"},
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer l.Close()
+
+			// 读取完所有数据后才返回应答，验证半关闭
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						buf, _ := io.ReadAll(c)
+						c.Write(buf)
+						c.Close()
+					}()
+				}
+			}()
+
+			port := uint16(l.Addr().(*net.TCPAddr).Port)
+			makeDial := func(path string) Dialer {
+				dial, err := MakeDialerWithConfig(&DialConfig{
+					Network: "h2",
+					Address: "127.0.0.1",
+					Port:    port,
+					Path:    path,
+					TLS:     tt.clientTLS,
+					H2:      &H2Config{Host: "cdn.example.com"},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return dial
+			}
+
+			_, err = makeDial("/other")()
+			assert.NotNil(t, err)
+
+			dial := makeDial("/tunnel")
+			c1, err := dial()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c1.Close()
+			c2, err := dial()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c2.Close()
+
+			// 共用同一条TCP连接
+			assert.Equal(t, c1.LocalAddr(), c2.LocalAddr())
+
+			for i, c := range []net.Conn{c1, c2} {
+				c.SetDeadline(time.Now().Add(time.Second * 5))
+				payload := []byte{byte(i), 1, 2, 3}
+				c.Write(payload)
+				assert.Nil(t, c.(interface{ CloseWrite() error }).CloseWrite())
+				resp, err := io.ReadAll(c)
+				assert.Nil(t, err)
+				assert.Equal(t, payload, resp)
+			}
+		})
+	}
+}
+
+// 服务端先结束应答，请求体仍然可以继续读取
+func TestH2ServerCloseWrite(t *testing.T) {
+	for _, network := range []string{"h2", "grpc"} {
+		t.Run(network, func(t *testing.T) {
+			l, err := MakeListener(&ListenConfig{Network: network, Address: "127.0.0.1"})
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer l.Close()
+
+			received := make(chan []byte, 1)
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.Write([]byte("response"))
+				if !assert.Nil(t, c.(interface{ CloseWrite() error }).CloseWrite()) {
+					return
+				}
+				buf, _ := io.ReadAll(c)
+				received <- buf
+			}()
+
+			dial, err := MakeDialerWithConfig(&DialConfig{
+				Network: network,
+				Address: "127.0.0.1",
+				Port:    uint16(l.Addr().(*net.TCPAddr).Port),
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+			c, err := dial()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+
+			resp, err := io.ReadAll(c)
+			assert.Nil(t, err)
+			assert.Equal(t, "response", string(resp))
+
+			payload := make([]byte, h2StreamWindow*3)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			n, err := c.Write(payload)
+			assert.Nil(t, err)
+			assert.Equal(t, len(payload), n)
+			assert.Nil(t, c.(interface{ CloseWrite() error }).CloseWrite())
+
+			select {
+			case buf := <-received:
+				assert.Equal(t, payload, buf)
+			case <-time.After(time.Second * 5):
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
+
+// 读写超时后返回os.ErrDeadlineExceeded，连接仍然可以继续使用
+func TestH2Deadline(t *testing.T) {
+	for _, network := range []string{"h2", "grpc"} {
+		t.Run(network, func(t *testing.T) {
+			l, err := MakeListener(&ListenConfig{Network: network, Address: "127.0.0.1"})
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer l.Close()
+
+			serverErr := make(chan error, 1)
+			resume := make(chan struct{})
+			received := make(chan int64, 1)
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+				_, err = c.Read(make([]byte, 8))
+				serverErr <- err
+
+				<-resume
+				c.SetReadDeadline(time.Time{})
+				c.Write([]byte("hello"))
+				n, _ := io.Copy(io.Discard, c)
+				received <- n
+			}()
+
+			dial, err := MakeDialerWithConfig(&DialConfig{
+				Network: network,
+				Address: "127.0.0.1",
+				Port:    uint16(l.Addr().(*net.TCPAddr).Port),
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+			c, err := dial()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c.Close()
+
+			assert.ErrorIs(t, <-serverErr, os.ErrDeadlineExceeded)
+
+			// 服务端不读取时，写满窗口后写入超时
+			c.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+			payload := make([]byte, 64<<10)
+			var written int64
+			for {
+				_, err = c.Write(payload)
+				if err != nil {
+					break
+				}
+				written += int64(len(payload))
+			}
+			assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+			c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+			_, err = c.Read(make([]byte, 8))
+			assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+			close(resume)
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello", string(buf))
+
+			// 超时的写入在后台完成，之后的写入与结束写入都在它之后
+			_, err = c.Write(payload)
+			assert.Nil(t, err)
+			assert.Nil(t, c.(interface{ CloseWrite() error }).CloseWrite())
+			select {
+			case n := <-received:
+				assert.Equal(t, written+int64(2*len(payload)), n)
+			case <-time.After(time.Second * 5):
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
+
+// 等待Accept的流有数量上限，被对端重置的流在Accept之前仍然占用位置
+func TestH2ServerPendingStreams(t *testing.T) {
+	l, err := MakeListener(&ListenConfig{Network: "h2", Address: "127.0.0.1"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	dial, err := MakeDialerWithConfig(&DialConfig{
+		Network: "h2",
+		Address: "127.0.0.1",
+		Port:    uint16(l.Addr().(*net.TCPAddr).Port),
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < h2MaxPending; i++ {
+		c, err := dial()
+		if !assert.Nil(t, err) {
+			return
+		}
+		c.Close()
+	}
+	_, err = dial()
+	assert.NotNil(t, err)
+
+	// Accept之后空出位置
+	c, err := l.Accept()
+	if !assert.Nil(t, err) {
+		return
+	}
+	c.Close()
+	c, err = dial()
+	if assert.Nil(t, err) {
+		c.Close()
+	}
+}
+
+// 客户端配置的ALPN保留在h2之后
+func TestH2ClientNextProtos(t *testing.T) {
+	tlsConfig := &tls.Config{NextProtos: []string{"http/1.1"}}
+	newH2Client(&DialConfig{Address: "127.0.0.1", Port: 443}, tlsConfig, "", "/", nil)
+	assert.Equal(t, []string{"h2", "http/1.1"}, tlsConfig.NextProtos)
+}
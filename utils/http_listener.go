@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// 将HTTP请求中建立的连接转换为net.Listener，供ws使用
+type httpListener struct {
+	net.Listener
+	server *http.Server
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHTTPListener(l net.Listener) *httpListener {
+	return &httpListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// 启动HTTP服务，需要在设置server之后调用
+func (hl *httpListener) serve() {
+	go hl.server.Serve(hl.Listener)
+}
+
+// 将连接交给Accept，并等待连接关闭，请求处理函数返回后连接不再可用
+// 交出后连接的生命周期与监听无关，关闭监听时已经Accept的连接继续使用
+func (hl *httpListener) push(c net.Conn, closed <-chan struct{}) {
+	select {
+	case hl.conns <- c:
+	case <-hl.done:
+		return
+	}
+	<-closed
+}
+
+func (hl *httpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-hl.conns:
+		return c, nil
+	case <-hl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (hl *httpListener) Close() error {
+	hl.closeOnce.Do(func() { close(hl.done) })
+	return hl.server.Close()
+}
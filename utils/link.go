@@ -3,45 +3,202 @@ package utils
 import (
 	"io"
 	"log"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
-func LinkReadWriter(dist, src io.ReadWriter) (distReaded, distWritten int64, retErr error) {
+// 单个UDP数据包的最大长度
+const MaxPacketSize = 64 * 1024
+
+// UDP会话默认的空闲超时时间
+const DefaultPacketIdleTimeout = time.Minute
+
+// TCP连接默认的空闲超时时间
+const DefaultIdleTimeout = time.Minute * 5
+
+// 单个方向的转发结果
+type LinkResult struct {
+	N   int64 // 转发的字节数
+	Err error // 为nil表示读取到io.EOF正常结束
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// 双向转发，分别返回两个方向的结果
+// * toDist：从src读取并写入dist
+// * toSrc：从dist读取并写入src
+//
+// 单方向正常结束时，通过CloseWrite通知对端，另一方向继续转发
+// 任一方向出错、对端不支持CloseWrite，或者双向都没有数据往来超过idle时长时，
+// 关闭两端的连接。idle为0表示不限制
+func LinkReadWriter(dist, src io.ReadWriter, idle time.Duration) (toDist, toSrc LinkResult) {
+	active := new(int64)
+	atomic.StoreInt64(active, time.Now().UnixNano())
+
+	// 单方向结束后能否继续转发另一方向：出错或者对端不支持半关闭时，需要结束整个转发
+	done := make(chan bool, 2)
+	copyHalf := func(dst, src io.ReadWriter, ret *LinkResult) {
+		ret.N, ret.Err = io.Copy(&activeWriter{w: dst, active: active}, src)
+		halfClosed := false
+		if ret.Err == nil {
+			if cw, ok := dst.(closeWriter); ok {
+				halfClosed = cw.CloseWrite() == nil
+			}
+		}
+		done <- halfClosed
+	}
+	go copyHalf(dist, src, &toDist)
+	go copyHalf(src, dist, &toSrc)
+
+	var timeout <-chan time.Time
+	if idle > 0 {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	closeBoth := func() {
+		if c, ok := dist.(io.Closer); ok {
+			c.Close()
+		}
+		if c, ok := src.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	aborted := false
+	for finished := 0; finished < 2; {
+		select {
+		case halfClosed := <-done:
+			finished++
+			if !halfClosed && !aborted {
+				aborted = true
+				closeBoth()
+			}
+		case <-timeout:
+			elapsed := time.Since(time.Unix(0, atomic.LoadInt64(active)))
+			if elapsed < idle {
+				timeout = time.After(idle - elapsed)
+				continue
+			}
+			if !aborted {
+				aborted = true
+				closeBoth()
+			}
+		}
+	}
+
+	return
+}
+
+// 记录最后一次写入数据的时间
+type activeWriter struct {
+	w      io.Writer
+	active *int64
+}
+
+func (aw *activeWriter) Write(buf []byte) (int, error) {
+	atomic.StoreInt64(aw.active, time.Now().UnixNano())
+	return aw.w.Write(buf)
+}
+
+func LinkAndLog(addr string, dst, src io.ReadWriter, idle time.Duration) {
+	start := time.Now()
+	r, w := LinkReadWriter(dst, src, idle)
+	elapse := time.Since(start)
+
+	log.Printf("complete. live='%v' r='%v' w='%v' addr='%v', rerr='%v' werr='%v'\n",
+		elapse, ByteUnit(uint64(r.N)), ByteUnit(uint64(w.N)), addr, r.Err, w.Err)
+}
+
+// 以数据包为单位进行双向转发，每次Read得到的数据作为一个完整的包写出
+// 会话的生命周期与NAT映射类似：双向都没有数据往来超过idle时长后，关闭两端的连接结束会话
+// 不使用读超时，超时可能打断分帧传输中的数据包（例如vmess的chunk、vless的长度前缀）
+func LinkPacket(dist, src net.Conn, idle time.Duration) (distReaded, distWritten int64, retErr error) {
+	active := new(int64)
+	atomic.StoreInt64(active, time.Now().UnixNano())
+
+	copyPacket := func(dst, src net.Conn) (int64, error) {
+		buf := make([]byte, MaxPacketSize)
+		written := int64(0)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(active, time.Now().UnixNano())
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return written, err
+				}
+				written += int64(n)
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
 	errChan := make(chan error, 2)
 
 	go func() {
 		var err error
-		distReaded, err = io.Copy(dist, src)
+		distReaded, err = copyPacket(dist, src)
 		errChan <- err
 	}()
 
 	go func() {
 		var err error
-		distWritten, err = io.Copy(src, dist)
+		distWritten, err = copyPacket(src, dist)
 		errChan <- err
 	}()
 
-	// 等待第一个错误返回
-	err := <-errChan
+	var timeout <-chan time.Time
+	if idle > 0 {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 
-	// 等待第二个错误返回，1秒内不返回则忽略
-	select {
-	case <-errChan:
-	case <-time.After(time.Second * 1):
+	// 任一方向结束或者空闲超时，关闭两端的连接，唤醒另一方向的读取
+	aborted := false
+	closeBoth := func() {
+		aborted = true
+		dist.Close()
+		src.Close()
 	}
 
-	if err != nil && err != io.EOF {
-		retErr = err
+	for finished := 0; finished < 2; {
+		select {
+		case err := <-errChan:
+			finished++
+			if aborted {
+				continue
+			}
+			if err != io.EOF {
+				retErr = err
+			}
+			closeBoth()
+		case <-timeout:
+			elapsed := time.Since(time.Unix(0, atomic.LoadInt64(active)))
+			if elapsed < idle {
+				timeout = time.After(idle - elapsed)
+				continue
+			}
+			if !aborted {
+				closeBoth()
+			}
+		}
 	}
 
 	return
 }
 
-func LinkAndLog(addr string, dst, src io.ReadWriter) {
+func LinkPacketAndLog(addr string, dst, src net.Conn, idle time.Duration) {
 	start := time.Now()
-	rn, wn, err := LinkReadWriter(dst, src)
+	rn, wn, err := LinkPacket(dst, src, idle)
 	elapse := time.Since(start)
 
-	log.Printf("complete. live='%v' r='%v' w='%v' addr='%v', err='%v'\n",
+	log.Printf("complete. live='%v' r='%v' w='%v' addr='%v' udp, err='%v'\n",
 		elapse, ByteUnit(uint64(rn)), ByteUnit(uint64(wn)), addr, err)
 }
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 建立一对TCP连接，TCP连接支持CloseWrite
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, <-ch
+}
+
+func TestLinkReadWriterHalfClose(t *testing.T) {
+	client, srcConn := tcpPair(t)
+	distConn, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	// 目标读取完所有数据后才返回应答
+	go func() {
+		buf, _ := io.ReadAll(target)
+		target.Write([]byte("received:"))
+		target.Write(buf)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+
+	type result struct{ toDist, toSrc LinkResult }
+	done := make(chan result, 1)
+	go func() {
+		r, w := LinkReadWriter(distConn, srcConn, time.Second*5)
+		done <- result{r, w}
+	}()
+
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	resp, err := io.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "received:hello", string(resp))
+
+	ret := <-done
+	assert.Equal(t, LinkResult{N: 5}, ret.toDist)
+	assert.Equal(t, LinkResult{N: 14}, ret.toSrc)
+}
+
+func TestLinkReadWriterIdle(t *testing.T) {
+	client, srcConn := tcpPair(t)
+	distConn, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	start := time.Now()
+	toDist, toSrc := LinkReadWriter(distConn, srcConn, time.Millisecond*200)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*200)
+	assert.Equal(t, int64(0), toDist.N)
+	assert.Equal(t, int64(0), toSrc.N)
+
+	// 超时后两端连接都已关闭
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// 带有2字节长度前缀的数据包，读取一个完整的包可能需要多次读取底层连接
+type framedConn struct {
+	net.Conn
+}
+
+func (c *framedConn) Read(buf []byte) (int, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.Conn, head[:]); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(c.Conn, buf[:int(head[0])<<8|int(head[1])])
+}
+
+// 另一方向保持活跃时，分帧传输中的数据包不会被超时打断；双向空闲后会话结束
+func TestLinkPacketIdle(t *testing.T) {
+	client, srcConn := tcpPair(t)
+	distConn, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	idle := time.Millisecond * 200
+	done := make(chan int64, 1)
+	go func() {
+		rn, _, _ := LinkPacket(distConn, &framedConn{srcConn}, idle)
+		done <- rn
+	}()
+
+	go func() {
+		for i := 0; i < 8; i++ {
+			target.Write([]byte("ping"))
+			time.Sleep(idle / 4)
+		}
+	}()
+	client.Write([]byte{0, 5})
+	time.Sleep(idle * 3 / 2)
+	client.Write([]byte("hello"))
+
+	target.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 16)
+	n, err := target.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	select {
+	case rn := <-done:
+		assert.Equal(t, int64(5), rn)
+	case <-time.After(time.Second * 5):
+		t.Fatal("link not closed after idle")
+	}
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 服务端监听的配置，与DialConfig对应
+type ListenConfig struct {
+	Network string // tcp/ws/wss/h2/grpc
+	Address string
+	Port    uint16
+	TLS     *TLSServerConfig  // 为nil时不使用TLS，network为wss时必须设置
+	WS      *WSServerConfig   // network为ws/wss时有效，为nil时使用默认配置
+	H2      *H2ServerConfig   // network为h2时有效，没有设置TLS时使用h2c
+	GRPC    *GRPCServerConfig // network为grpc时有效，没有设置TLS时使用h2c
+}
+
+// 创建监听，得到的连接可以直接交给Session.Process处理
+func MakeListener(cfg *ListenConfig) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tlsConfig, err = cfg.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Network {
+	case "tcp", "ws", "wss", "h2", "grpc":
+	default:
+		return nil, errors.New("invalid network")
+	}
+	if cfg.Network == "wss" && tlsConfig == nil {
+		return nil, errors.New("wss requires tls config")
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf("%v:%v", cfg.Address, cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if cfg.Network == "h2" || cfg.Network == "grpc" {
+			tlsConfig.NextProtos = append([]string{"h2"}, tlsConfig.NextProtos...)
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	switch cfg.Network {
+	case "tcp":
+		return l, nil
+	case "h2":
+		return newH2Listener(l, cfg.H2), nil
+	case "grpc":
+		return newGRPCListener(l, cfg.GRPC), nil
+	default:
+		return newWSListener(l, cfg.WS), nil
+	}
+}
+
+// 证书与私钥文件，PEM格式
+type CertFile struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// TLS服务端配置
+type TLSServerConfig struct {
+	Certificates []CertFile `json:"certificates"` // 根据客户端的SNI选择证书，都不匹配时使用第一个
+	ALPN         []string   `json:"alpn"`
+
+	// 检查证书文件是否更新的间隔（秒），文件更新后自动重新加载，0表示不检查
+	ReloadInterval int `json:"reloadInterval"`
+}
+
+func (c *TLSServerConfig) Build() (*tls.Config, error) {
+	if len(c.Certificates) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	store := &certStore{
+		files:    c.Certificates,
+		interval: time.Duration(c.ReloadInterval) * time.Second,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: store.getCertificate,
+		NextProtos:     c.ALPN,
+	}, nil
+}
+
+// 证书缓存，在握手时检查文件是否更新
+type certStore struct {
+	files    []CertFile
+	interval time.Duration
+
+	mu      sync.Mutex
+	certs   []*tls.Certificate
+	modTime time.Time // 所有证书文件中最新的修改时间
+	checked time.Time
+}
+
+func (s *certStore) load() error {
+	modTime, err := s.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.modTime = modTime
+	s.checked = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *certStore) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range s.files {
+		for _, name := range []string{f.Cert, f.Key} {
+			info, err := os.Stat(name)
+			if err != nil {
+				return latest, err
+			}
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+	}
+	return latest, nil
+}
+
+// 超过检查间隔时重新加载有变化的证书，加载失败时继续使用旧的证书
+func (s *certStore) reload() {
+	if s.interval <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	if time.Since(s.checked) < s.interval {
+		s.mu.Unlock()
+		return
+	}
+	s.checked = time.Now()
+	prev := s.modTime
+	s.mu.Unlock()
+
+	modTime, err := s.latestModTime()
+	if err != nil || !modTime.After(prev) {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Printf("reload certificates failed: %v\n", err)
+		return
+	}
+	log.Println("certificates reloaded")
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.reload()
+
+	s.mu.Lock()
+	certs := s.certs
+	s.mu.Unlock()
+
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certs[0], nil
+}
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func writeCertFile(t *testing.T, dir, name string) CertFile {
+	cert, _ := genCert(t, name)
+	f := CertFile{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(f.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(f.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	return f
+}
+
+func runEchoListener(l net.Listener) {
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+}
+
+func TestMakeListenerTLS(t *testing.T) {
+	dir := t.TempDir()
+	l, err := MakeListener(&ListenConfig{
+		Network: "tcp",
+		Address: "127.0.0.1",
+		TLS: &TLSServerConfig{Certificates: []CertFile{
+			writeCertFile(t, dir, "a.example.com"),
+			writeCertFile(t, dir, "b.example.com"),
+		}},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	runEchoListener(l)
+
+	// 根据SNI选择证书，不匹配时使用第一个
+	for sni, want := range map[string]string{
+		"a.example.com": "a.example.com",
+		"b.example.com": "b.example.com",
+		"c.example.com": "a.example.com",
+	} {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, want, c.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		c.Close()
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	f := writeCertFile(t, dir, "a.example.com")
+	store := &certStore{files: []CertFile{f}, interval: time.Millisecond}
+	if !assert.Nil(t, store.load()) {
+		return
+	}
+
+	// 证书文件更新后重新加载
+	updated := writeCertFile(t, t.TempDir(), "b.example.com")
+	os.Rename(updated.Cert, f.Cert)
+	os.Rename(updated.Key, f.Key)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(f.Cert, future, future)
+	os.Chtimes(f.Key, future, future)
+	time.Sleep(time.Millisecond * 5)
+
+	cert, err := store.getCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "b.example.com", certName(t, cert))
+
+	// 加载失败时继续使用旧的证书
+	os.WriteFile(f.Cert, []byte("invalid"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(f.Cert, future, future)
+	time.Sleep(time.Millisecond * 5)
+
+	cert, err = store.getCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "b.example.com", certName(t, cert))
+}
+
+func TestMakeListenerWS(t *testing.T) {
+	l, err := MakeListener(&ListenConfig{
+		Network: "ws",
+		Address: "127.0.0.1",
+		WS:      &WSServerConfig{Path: "/ws", Host: "cdn.example.com", EarlyDataHeader: DefaultEarlyDataHeader},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	dial := func(path, host string) (net.Conn, error) {
+		d, err := MakeDialerWithConfig(&DialConfig{
+			Network: "ws",
+			Address: "127.0.0.1",
+			Port:    port,
+			Path:    path,
+			WS:      &WSConfig{Host: host},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return d()
+	}
+
+	// 路径或者Host不匹配时握手失败
+	_, err = dial("/other", "cdn.example.com")
+	assert.NotNil(t, err)
+	_, err = dial("/ws", "other.example.com")
+	assert.NotNil(t, err)
+
+	// 请求头中的early data在读取时位于最前面
+	c, err := dial("/ws?ed=5", "cdn.example.com")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	c.Write([]byte("hello world"))
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	sc := <-accepted
+	assert.Equal(t, "127.0.0.1", sc.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+// 服务端使用二进制帧；没有配置early data时，Sec-WebSocket-Protocol中的子协议不会被当作数据
+func TestMakeListenerWSFrames(t *testing.T) {
+	l, err := MakeListener(&ListenConfig{Network: "ws", Address: "127.0.0.1"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hi"))
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	config, err := websocket.NewConfig("ws://"+l.Addr().String()+"/", DefaultWSOrigin)
+	if !assert.Nil(t, err) {
+		return
+	}
+	config.Protocol = []string{"chat"}
+	ws, err := websocket.DialConfig(config)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(time.Second * 5))
+
+	var payloadType byte
+	var data string
+	codec := websocket.Codec{Unmarshal: func(msg []byte, pt byte, v interface{}) error {
+		payloadType, data = pt, string(msg)
+		return nil
+	}}
+	assert.Nil(t, codec.Receive(ws, nil))
+	assert.Equal(t, byte(websocket.BinaryFrame), payloadType)
+	assert.Equal(t, "hi", data)
+
+	ws.Write([]byte("hello"))
+	assert.Nil(t, codec.Receive(ws, nil))
+	assert.Equal(t, "hello", data)
+}
+
+func certName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
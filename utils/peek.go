@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+)
+
+// 记录握手阶段读取的数据，认证失败时可以回放给回落目标
+type PeekConn struct {
+	net.Conn
+	recorded bytes.Buffer
+	reader   io.Reader // 回放时先读取已记录的数据
+}
+
+// consumed为调用方在此之前已经从c读取的数据，回放时位于最前面
+func NewPeekConn(c net.Conn, consumed []byte) *PeekConn {
+	pc := &PeekConn{Conn: c}
+	pc.recorded.Write(consumed)
+	return pc
+}
+
+func (pc *PeekConn) Read(buf []byte) (int, error) {
+	if pc.reader != nil {
+		return pc.reader.Read(buf)
+	}
+	n, err := pc.Conn.Read(buf)
+	pc.recorded.Write(buf[:n])
+	return n, err
+}
+
+// 已经记录的数据
+func (pc *PeekConn) Bytes() []byte { return pc.recorded.Bytes() }
+
+// 额外读取一次数据并记录，用于获取更完整的首包
+func (pc *PeekConn) Fill() error {
+	if pc.reader != nil {
+		return errors.New("peek conn rewound")
+	}
+	buf := make([]byte, 4096)
+	_, err := pc.Read(buf)
+	return err
+}
+
+// 停止记录，之后的读取从已记录数据的开头重新开始
+func (pc *PeekConn) Rewind() {
+	if pc.reader == nil {
+		pc.reader = io.MultiReader(bytes.NewReader(pc.recorded.Bytes()), pc.Conn)
+	}
+}
+
+func (pc *PeekConn) CloseWrite() error {
+	if cw, ok := pc.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
+}
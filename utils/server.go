@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// 连接处理函数，返回后连接会被关闭
+type ConnHandler func(c net.Conn) error
+
+// 通用的服务端连接管理：接受连接、限制并发数、跟踪活跃连接，支持优雅关闭
+type Server struct {
+	handler ConnHandler
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	slots     chan struct{} // maxConns大于0时用于限制并发数
+	done      chan struct{}
+	closed    bool
+}
+
+// 创建服务，maxConns为同时处理的最大连接数，0表示不限制
+// 达到上限时暂停Accept，直到有连接结束
+func NewServer(handler ConnHandler, maxConns int) *Server {
+	s := &Server{
+		handler:   handler,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		done:      make(chan struct{}),
+	}
+	if maxConns > 0 {
+		s.slots = make(chan struct{}, maxConns)
+	}
+	return s
+}
+
+// 在监听上接受连接，直到监听出错或者服务被关闭
+// 服务被关闭时返回ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var delay time.Duration
+	for {
+		if !s.acquire() {
+			return ErrServerClosed
+		}
+
+		c, err := l.Accept()
+		if err != nil {
+			s.release()
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			// 与net/http一致，临时错误（例如文件描述符耗尽）时等待后重试
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				delay = nextAcceptDelay(delay)
+				log.Printf("accept failed: %v, retrying in %v\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if !s.trackConn(c, true) {
+			s.release()
+			c.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(c)
+	}
+}
+
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer s.release()
+	defer s.trackConn(c, false)
+	defer c.Close()
+
+	if err := s.handler(c); err != nil {
+		log.Printf("process failed: %v\n", err)
+	}
+}
+
+// 当前正在处理的连接数
+func (s *Server) ActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// 停止接受新连接，等待已有连接处理完毕
+// ctx结束时强制关闭剩余的连接，并返回ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// 立即关闭所有监听与连接
+func (s *Server) Close() error {
+	s.closeListeners()
+	s.closeConns()
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.closed {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.closed {
+			return false
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+	} else {
+		delete(s.conns, c)
+		s.wg.Done()
+	}
+	return true
+}
+
+// 获取一个连接名额，服务关闭时返回false
+func (s *Server) acquire() bool {
+	if s.slots == nil {
+		return !s.isClosed()
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *Server) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	s := NewServer(func(c net.Conn) error {
+		c.Write([]byte("hi"))
+		<-release
+		return nil
+	}, 0)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(l) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	io.ReadFull(c, make([]byte, 2))
+	assert.Equal(t, 1, s.ActiveConns())
+
+	// 连接结束前Shutdown不会返回
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+	select {
+	case <-shutdownErr:
+		t.Error("shutdown returned before connection finished")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	assert.Nil(t, <-shutdownErr)
+	assert.Equal(t, 0, s.ActiveConns())
+
+	// 关闭后不再接受新的监听
+	l2, _ := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, ErrServerClosed, s.Serve(l2))
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(func(c net.Conn) error {
+		_, err := io.Copy(io.Discard, c)
+		return err
+	}, 0)
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	for s.ActiveConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 超时后强制关闭剩余的连接
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	assert.Equal(t, 0, s.ActiveConns())
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerMaxConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(func(c net.Conn) error {
+		c.Write([]byte("hi"))
+		_, err := io.Copy(io.Discard, c)
+		return err
+	}, 1)
+	go s.Serve(l)
+	defer s.Close()
+
+	c1, _ := net.Dial("tcp", l.Addr().String())
+	defer c1.Close()
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(c1, make([]byte, 2))
+	assert.Nil(t, err)
+
+	// 达到上限后，新的连接要等待已有连接结束才会被处理
+	c2, _ := net.Dial("tcp", l.Addr().String())
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = io.ReadFull(c2, make([]byte, 2))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, s.ActiveConns())
+
+	c1.Close()
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(c2, make([]byte, 2))
+	assert.Nil(t, err)
+}
+
+// Shutdown期间已经建立的隧道连接继续转发，直到连接结束
+func TestServerShutdownDrain(t *testing.T) {
+	for _, network := range []string{"ws", "h2", "grpc"} {
+		t.Run(network, func(t *testing.T) {
+			l, err := MakeListener(&ListenConfig{Network: network, Address: "127.0.0.1"})
+			if !assert.Nil(t, err) {
+				return
+			}
+			s := NewServer(func(c net.Conn) error {
+				_, err := io.Copy(c, c)
+				return err
+			}, 0)
+			go s.Serve(l)
+
+			dial, err := MakeDialerWithConfig(&DialConfig{
+				Network: network,
+				Address: "127.0.0.1",
+				Port:    uint16(l.Addr().(*net.TCPAddr).Port),
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+			c, err := dial()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+			buf := make([]byte, 5)
+			c.Write([]byte("hello"))
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+
+			shutdownErr := make(chan error, 1)
+			go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+			time.Sleep(time.Millisecond * 50)
+
+			c.Write([]byte("world"))
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, "world", string(buf))
+			select {
+			case <-shutdownErr:
+				t.Error("shutdown returned before connection finished")
+			default:
+			}
+
+			c.Close()
+			select {
+			case err := <-shutdownErr:
+				assert.Nil(t, err)
+			case <-time.After(time.Second * 5):
+				t.Fatal("shutdown not finished")
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrPinMismatch = errors.New("certificate pin mismatch")
+
+// TLS客户端配置
+type TLSConfig struct {
+	ServerName string   `json:"sni"`        // 为空时使用连接的地址
+	ALPN       []string `json:"alpn"`       // 例如["h2", "http/1.1"]
+	CA         string   `json:"ca"`         // PEM格式的CA证书文件，为空时使用系统证书
+	PinnedSPKI []string `json:"pinnedSpki"` // 证书公钥（SPKI）的SHA256，base64编码，匹配校验后证书链中的任意一个即可
+	Insecure   bool     `json:"insecure"`   // 不校验证书链与域名，设置了PinnedSPKI时仍然校验叶子证书的公钥
+}
+
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		NextProtos:         c.ALPN,
+		InsecureSkipVerify: c.Insecure,
+	}
+
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca='%v'", c.CA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(c.PinnedSPKI) > 0 {
+		pins := make(map[[sha256.Size]byte]bool)
+		for _, pin := range c.PinnedSPKI {
+			buf, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(buf) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin='%v'", pin)
+			}
+			var h [sha256.Size]byte
+			copy(h[:], buf)
+			pins[h] = true
+		}
+		// 在证书链校验之后执行，Insecure时同样会执行
+		// Insecure时证书链没有经过校验，服务端可以附带任意证书，只能比较叶子证书
+		insecure := c.Insecure
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if insecure {
+				if len(cs.PeerCertificates) > 0 && pins[sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+				return ErrPinMismatch
+			}
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+
+	return cfg, nil
+}
+
+// 计算证书公钥的指纹，用于TLSConfig.PinnedSPKI
+func SPKIHash(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// 解析客户端配置中的tls字段，"tls"表示启用，""与"none"表示不启用
+// 启用时settings可以为nil，表示使用默认配置
+func ParseTLS(security string, settings *TLSConfig) (*TLSConfig, error) {
+	switch security {
+	case "", "none":
+		return nil, nil
+	case "tls":
+		if settings == nil {
+			settings = &TLSConfig{}
+		}
+		return settings, nil
+	default:
+		return nil, fmt.Errorf("tls='%v' not supported", security)
+	}
+}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// 生成自签名证书，同时作为CA使用
+func genCert(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestMakeDialerTLS(t *testing.T) {
+	cert, x509Cert := genCert(t, "example.com")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: x509Cert.Raw}), 0600)
+	_, other := genCert(t, "example.com")
+
+	port := l.Addr().(*net.TCPAddr).Port
+	tests := []struct {
+		name    string
+		tls     *TLSConfig
+		wantErr bool
+		alpn    string
+	}{
+		{"system ca", &TLSConfig{}, true, ""},
+		{"insecure", &TLSConfig{Insecure: true}, false, ""},
+		{"custom ca", &TLSConfig{CA: caFile}, false, ""},
+		{"sni", &TLSConfig{CA: caFile, ServerName: "example.com"}, false, ""},
+		{"sni mismatch", &TLSConfig{CA: caFile, ServerName: "other.com"}, true, ""},
+		{"alpn", &TLSConfig{Insecure: true, ALPN: []string{"h2"}}, false, "h2"},
+		{"pin", &TLSConfig{Insecure: true, PinnedSPKI: []string{SPKIHash(x509Cert)}}, false, ""},
+		{"pin verified", &TLSConfig{CA: caFile, PinnedSPKI: []string{SPKIHash(x509Cert)}}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial, err := MakeDialerWithConfig(&DialConfig{Network: "tcp", Address: "127.0.0.1", Port: uint16(port), TLS: tt.tls})
+			if !assert.Nil(t, err) {
+				return
+			}
+			c, err := dial()
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c.Close()
+			assert.Equal(t, tt.alpn, ConnALPN(c))
+
+			c.Write([]byte("hello"))
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello", string(buf))
+		})
+	}
+
+	dial, _ := MakeDialerWithConfig(&DialConfig{Network: "tcp", Address: "127.0.0.1", Port: uint16(port),
+		TLS: &TLSConfig{Insecure: true, PinnedSPKI: []string{SPKIHash(other)}}})
+	_, err = dial()
+	assert.True(t, errors.Is(err, ErrPinMismatch))
+
+	_, err = MakeDialerWithConfig(&DialConfig{Network: "tcp", TLS: &TLSConfig{PinnedSPKI: []string{"invalid"}}})
+	assert.NotNil(t, err)
+}
+
+// 服务端在无关的叶子证书后面附带被固定的证书，不能通过校验
+func TestPinnedSPKIChainEntry(t *testing.T) {
+	leaf, _ := genCert(t, "example.com")
+	pinned, pinnedX509 := genCert(t, "example.com")
+	leaf.Certificate = append(leaf.Certificate, pinned.Certificate[0])
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{leaf}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pinnedX509.Raw}), 0600)
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	dial := func(cfg *TLSConfig) error {
+		dial, err := MakeDialerWithConfig(&DialConfig{Network: "tcp", Address: "127.0.0.1", Port: port, TLS: cfg})
+		if err != nil {
+			return err
+		}
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	err = dial(&TLSConfig{Insecure: true, PinnedSPKI: []string{SPKIHash(pinnedX509)}})
+	assert.True(t, errors.Is(err, ErrPinMismatch))
+	// 叶子证书不是由被固定的证书签发的，证书链校验失败
+	err = dial(&TLSConfig{CA: caFile, PinnedSPKI: []string{SPKIHash(pinnedX509)}})
+	assert.NotNil(t, err)
+}
+
+func TestMakeDialerWSS(t *testing.T) {
+	s := httptest.NewTLSServer(websocket.Handler(func(c *websocket.Conn) { io.Copy(c, c) }))
+	defer s.Close()
+	addr := s.Listener.Addr().(*net.TCPAddr)
+
+	dial, err := MakeDialerWithConfig(&DialConfig{
+		Network: "ws",
+		Address: "127.0.0.1",
+		Port:    uint16(addr.Port),
+		Path:    "/",
+		TLS:     &TLSConfig{Insecure: true, PinnedSPKI: []string{SPKIHash(s.Certificate())}},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	c, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
@@ -11,3 +11,9 @@ func ParseUUID(id string) (userid []byte, err error) {
 	err = nil
 	return
 }
+
+// 使用任意字符串生成UUID（UUIDv5，命名空间为全零），与Xray的映射方式一致
+func UUIDFromPassword(password string) []byte {
+	userid, _ := uuid.NewSHA1(uuid.Nil, []byte(password)).MarshalBinary()
+	return userid
+}
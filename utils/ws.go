@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	DefaultWSOrigin        = "http://qq.com/"
+	DefaultEarlyDataHeader = "Sec-WebSocket-Protocol"
+	earlyDataQueryKey      = "ed"
+)
+
+// WebSocket客户端配置
+type WSConfig struct {
+	Host     string            `json:"host"`     // Host请求头，为空时使用连接地址，用于CDN转发
+	Headers  map[string]string `json:"headers"`  // 额外的请求头，例如User-Agent
+	Origin   string            `json:"origin"`   // 为空时使用DefaultWSOrigin
+	Protocol string            `json:"protocol"` // Sec-WebSocket-Protocol
+
+	// 将第一次写入的数据（最多MaxEarlyData字节）放在握手请求头中发送，节省一次往返
+	// 路径中带有?ed=2048参数时，使用该参数的值并从路径中移除
+	MaxEarlyData    int    `json:"maxEarlyData"`
+	EarlyDataHeader string `json:"earlyDataHeader"` // 为空时使用DefaultEarlyDataHeader
+}
+
+// 在已经建立的连接上进行WebSocket握手
+type wsDialer struct {
+	config          *websocket.Config
+	maxEarlyData    int
+	earlyDataHeader string
+}
+
+func newWSDialer(cfg *WSConfig, scheme, address string, port uint16, path string) (*wsDialer, error) {
+	if cfg == nil {
+		cfg = &WSConfig{}
+	}
+
+	host := cfg.Host
+	if host == "" {
+		host = fmt.Sprintf("%v:%v", address, port)
+	}
+	u, err := url.Parse(fmt.Sprintf("%v://%v%v", scheme, host, path))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &wsDialer{maxEarlyData: cfg.MaxEarlyData, earlyDataHeader: cfg.EarlyDataHeader}
+	query := u.Query()
+	if ed := query.Get(earlyDataQueryKey); ed != "" {
+		d.maxEarlyData, err = strconv.Atoi(ed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid early data in path='%v'", path)
+		}
+		query.Del(earlyDataQueryKey)
+		u.RawQuery = query.Encode()
+	}
+	if d.earlyDataHeader == "" {
+		d.earlyDataHeader = DefaultEarlyDataHeader
+	}
+
+	origin := cfg.Origin
+	if origin == "" {
+		origin = DefaultWSOrigin
+	}
+	d.config, err = websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range cfg.Headers {
+		d.config.Header.Set(k, v)
+	}
+	if cfg.Protocol != "" {
+		d.config.Protocol = []string{cfg.Protocol}
+	}
+
+	return d, nil
+}
+
+// 进行握手，earlyData不为空时放在请求头中
+func (d *wsDialer) handshake(raw net.Conn, earlyData []byte) (net.Conn, error) {
+	config := *d.config
+	config.Header = d.config.Header.Clone()
+	if len(earlyData) > 0 {
+		ed := base64.RawURLEncoding.EncodeToString(earlyData)
+		if http.CanonicalHeaderKey(d.earlyDataHeader) == "Sec-Websocket-Protocol" {
+			config.Protocol = []string{ed}
+		} else {
+			config.Header.Set(d.earlyDataHeader, ed)
+		}
+	}
+
+	ws, err := websocket.NewClient(&config, raw)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+func (d *wsDialer) upgrade(raw net.Conn) (net.Conn, error) {
+	if d.maxEarlyData <= 0 {
+		return d.handshake(raw, nil)
+	}
+	return newEarlyDataConn(raw, d), nil
+}
+
+var errEarlyDataConnClosed = errors.New("connection closed before handshake")
+
+// 延迟到第一次写入时才进行握手，读取会等待握手完成
+// 握手在锁外进行，握手期间Close会关闭底层连接使握手失败
+// 握手前的地址与deadline由底层连接提供，等待握手的读取同样受读超时限制
+type earlyDataConn struct {
+	net.Conn
+	dialer *wsDialer
+
+	mu       sync.Mutex
+	started  bool
+	ws       net.Conn
+	err      error
+	ready    chan struct{} // 握手完成或连接关闭后关闭
+	rdead    time.Time
+	rchanged chan struct{} // 读超时被修改后关闭
+}
+
+func newEarlyDataConn(raw net.Conn, d *wsDialer) *earlyDataConn {
+	return &earlyDataConn{
+		Conn:     raw,
+		dialer:   d,
+		ready:    make(chan struct{}),
+		rchanged: make(chan struct{}),
+	}
+}
+
+// 调用前需要持有c.mu
+func (c *earlyDataConn) finish(ws net.Conn, err error) {
+	select {
+	case <-c.ready:
+	default:
+		c.ws, c.err = ws, err
+		close(c.ready)
+	}
+}
+
+func (c *earlyDataConn) Write(buf []byte) (int, error) {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		<-c.ready
+		if c.err != nil {
+			return 0, c.err
+		}
+		return c.ws.Write(buf)
+	}
+	c.started = true
+	c.mu.Unlock()
+
+	early := buf
+	if len(early) > c.dialer.maxEarlyData {
+		early = early[:c.dialer.maxEarlyData]
+	}
+	ws, err := c.dialer.handshake(c.Conn, early)
+
+	c.mu.Lock()
+	c.finish(ws, err)
+	if c.ws != ws && ws != nil {
+		ws.Close() // 握手期间连接已经被关闭
+	}
+	ws, err = c.ws, c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if len(early) == len(buf) {
+		return len(buf), nil
+	}
+	n, err := ws.Write(buf[len(early):])
+	return len(early) + n, err
+}
+
+func (c *earlyDataConn) Read(buf []byte) (int, error) {
+	if err := c.waitReady(); err != nil {
+		return 0, err
+	}
+	return c.ws.Read(buf)
+}
+
+// 等待握手完成，读超时在等待期间被修改时重新计时
+func (c *earlyDataConn) waitReady() error {
+	for {
+		c.mu.Lock()
+		t, changed := c.rdead, c.rchanged
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !t.IsZero() {
+			timer = time.NewTimer(time.Until(t))
+			timeout = timer.C
+		}
+
+		done, err := false, error(nil)
+		select {
+		case <-c.ready:
+			done, err = true, c.err
+		case <-timeout:
+			done, err = true, os.ErrDeadlineExceeded
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return err
+		}
+	}
+}
+
+func (c *earlyDataConn) Close() error {
+	c.mu.Lock()
+	c.finish(nil, errEarlyDataConnClosed)
+	ws := c.ws
+	c.mu.Unlock()
+
+	if ws != nil {
+		return ws.Close()
+	}
+	return c.Conn.Close()
+}
+
+func (c *earlyDataConn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *earlyDataConn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *earlyDataConn) setReadDeadline(t time.Time) {
+	c.mu.Lock()
+	c.rdead = t
+	close(c.rchanged)
+	c.rchanged = make(chan struct{})
+	c.mu.Unlock()
+}
+
+// 合并客户端配置中的host字段（与v2rayN的分享格式一致）与settings，settings中的Host优先
+func ParseWS(host string, settings *WSConfig) *WSConfig {
+	if host == "" {
+		return settings
+	}
+	ws := &WSConfig{}
+	if settings != nil {
+		*ws = *settings
+	}
+	if ws.Host == "" {
+		ws.Host = host
+	}
+	return ws
+}
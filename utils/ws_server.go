@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket服务端配置
+type WSServerConfig struct {
+	Path            string `json:"path"`            // 请求路径，为空时使用"/"，不匹配时返回404
+	Host            string `json:"host"`            // 不为空时校验Host请求头
+	EarlyDataHeader string `json:"earlyDataHeader"` // 为空时不读取early data，与客户端默认配置对应的值为DefaultEarlyDataHeader
+}
+
+// 将WebSocket连接转换为net.Listener
+type wsListener struct {
+	*httpListener
+	config *WSServerConfig
+}
+
+func newWSListener(l net.Listener, cfg *WSServerConfig) *wsListener {
+	config := WSServerConfig{}
+	if cfg != nil {
+		config = *cfg
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+
+	wl := &wsListener{httpListener: newHTTPListener(l), config: &config}
+	wl.server = &http.Server{Handler: wl}
+	wl.serve()
+	return wl
+}
+
+func (wl *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != wl.config.Path || (wl.config.Host != "" && hostname(r.Host) != hostname(wl.config.Host)) {
+		http.NotFound(w, r)
+		return
+	}
+	websocket.Server{Handshake: wl.handshake, Handler: wl.serveWS}.ServeHTTP(w, r)
+}
+
+// 不校验Origin，early data放在Sec-WebSocket-Protocol中时原样返回
+func (wl *wsListener) handshake(config *websocket.Config, r *http.Request) error {
+	return nil
+}
+
+func (wl *wsListener) serveWS(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	// 没有配置时不读取，避免把Sec-WebSocket-Protocol中真正的子协议当作数据
+	var early []byte
+	if header := wl.config.EarlyDataHeader; header != "" {
+		if buf, err := base64.RawURLEncoding.DecodeString(ws.Request().Header.Get(header)); err == nil {
+			early = buf
+		}
+	}
+
+	remote, _ := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	c := &wsServerConn{
+		Conn:   ws,
+		reader: io.MultiReader(bytes.NewReader(early), ws),
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+	wl.push(c, c.closed)
+}
+
+// 服务端的WebSocket连接，先读取请求头中的early data
+type wsServerConn struct {
+	*websocket.Conn
+	reader    io.Reader
+	remote    net.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *wsServerConn) Read(buf []byte) (int, error) { return c.reader.Read(buf) }
+
+// websocket.Conn在服务端返回的是请求地址，这里使用客户端的地址
+func (c *wsServerConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsServerConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// 记录握手请求，先回写请求头中的early data，再回写后续的数据
+func runWSEchoServer(t *testing.T, earlyDataHeader string) (*net.TCPAddr, <-chan *http.Request) {
+	reqs := make(chan *http.Request, 1)
+	s := httptest.NewServer(websocket.Server{
+		Handshake: func(cfg *websocket.Config, req *http.Request) error {
+			reqs <- req
+			return nil
+		},
+		Handler: func(c *websocket.Conn) {
+			if ed := c.Request().Header.Get(earlyDataHeader); ed != "" {
+				buf, _ := base64.RawURLEncoding.DecodeString(ed)
+				c.Write(buf)
+			}
+			io.Copy(c, c)
+		},
+	})
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().(*net.TCPAddr), reqs
+}
+
+func TestMakeDialerWS(t *testing.T) {
+	addr, reqs := runWSEchoServer(t, "")
+
+	dial, err := MakeDialerWithConfig(&DialConfig{
+		Network: "ws",
+		Address: "127.0.0.1",
+		Port:    uint16(addr.Port),
+		Path:    "/ws",
+		WS: &WSConfig{
+			Host:     "cdn.example.com",
+			Headers:  map[string]string{"User-Agent": "test-agent"},
+			Origin:   "https://example.com",
+			Protocol: "chat",
+		},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	c, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	req := <-reqs
+	assert.Equal(t, "cdn.example.com", req.Host)
+	assert.Equal(t, "/ws", req.URL.Path)
+	assert.Equal(t, "test-agent", req.Header.Get("User-Agent"))
+	assert.Equal(t, "https://example.com", req.Header.Get("Origin"))
+	assert.Equal(t, "chat", req.Header.Get("Sec-WebSocket-Protocol"))
+}
+
+func TestMakeDialerWSEarlyData(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		ws     *WSConfig
+		header string
+	}{
+		{"path", "/ws?ed=5", nil, "Sec-WebSocket-Protocol"},
+		{"config", "/ws", &WSConfig{MaxEarlyData: 5}, "Sec-WebSocket-Protocol"},
+		{"custom header", "/ws", &WSConfig{MaxEarlyData: 5, EarlyDataHeader: "X-Early-Data"}, "X-Early-Data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, reqs := runWSEchoServer(t, tt.header)
+			dial, err := MakeDialerWithConfig(&DialConfig{
+				Network: "ws",
+				Address: "127.0.0.1",
+				Port:    uint16(addr.Port),
+				Path:    tt.path,
+				WS:      tt.ws,
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+			c, err := dial()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+
+			// 握手在第一次写入时进行
+			n, err := c.Write([]byte("hello world"))
+			assert.Nil(t, err)
+			assert.Equal(t, 11, n)
+
+			req := <-reqs
+			assert.Equal(t, "/ws", req.URL.RequestURI())
+			assert.Equal(t, base64.RawURLEncoding.EncodeToString([]byte("hello")), req.Header.Get(tt.header))
+
+			buf := make([]byte, 11)
+			_, err = io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello world", string(buf))
+		})
+	}
+}
+
+// 服务端不回应握手时，读超时与Close都能结束等待
+func TestWSEarlyDataPendingHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	dial, err := MakeDialerWithConfig(&DialConfig{
+		Network: "ws",
+		Address: "127.0.0.1",
+		Port:    uint16(l.Addr().(*net.TCPAddr).Port),
+		Path:    "/ws?ed=2048",
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// 握手前的读取受读超时限制
+	c, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err = c.Read(make([]byte, 8))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// 握手期间关闭连接，写入与读取立即返回
+	c.SetReadDeadline(time.Time{})
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		writeErr <- err
+	}()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 8))
+		readErr <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	c.Close()
+
+	for _, ch := range []chan error{writeErr, readErr} {
+		select {
+		case err := <-ch:
+			assert.NotNil(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("handshake not aborted")
+		}
+	}
+}
+
+// 客户端发送的数据使用二进制帧，包括early data握手之后的写入
+func TestWSClientFrames(t *testing.T) {
+	frames := make(chan byte, 4)
+	s := httptest.NewServer(websocket.Handler(func(c *websocket.Conn) {
+		codec := websocket.Codec{Unmarshal: func(msg []byte, payloadType byte, v interface{}) error {
+			frames <- payloadType
+			return nil
+		}}
+		for codec.Receive(c, nil) == nil {
+		}
+	}))
+	defer s.Close()
+	port := uint16(s.Listener.Addr().(*net.TCPAddr).Port)
+
+	for _, path := range []string{"/", "/?ed=2"} {
+		dial, err := MakeDialerWithConfig(&DialConfig{Network: "ws", Address: "127.0.0.1", Port: port, Path: path})
+		if !assert.Nil(t, err) {
+			return
+		}
+		c, err := dial()
+		if !assert.Nil(t, err) {
+			return
+		}
+		c.Write([]byte("hello"))
+		select {
+		case pt := <-frames:
+			assert.Equal(t, byte(websocket.BinaryFrame), pt)
+		case <-time.After(time.Second * 5):
+			t.Fatal("frame not received")
+		}
+		c.Close()
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"log"
 	"net"
+	"time"
 
+	"github.com/net-agent/protocol/mux"
 	"github.com/net-agent/protocol/utils"
 )
 
@@ -14,12 +16,29 @@ type Config struct {
 	Address string `json:"add"`
 	Port    uint16 `json:"port"`
 	Path    string `json:"path"`
+	Host    string `json:"host"` // ws/h2的Host请求头，grpc的:authority
 	Id      string `json:"id"`
+	Pass    string `json:"pass"` // 没有设置id时，使用密码生成uuid
+	Mux     int    `json:"mux"`  // 单条连接上的最大子连接数，0表示不启用多路复用
+	Tls     string `json:"tls"`  // tls/none
+
+	// 指令的发送时机（毫秒）：0表示与第一次写入的数据一起发送，
+	// 小于0表示Upgrade时立即发送，大于0表示等待一段时间没有写入时单独发送
+	HeaderDelay int `json:"headerDelay"`
+
+	TLSSettings *utils.TLSConfig `json:"tlsSettings"` // tls为"tls"时有效，为空时使用默认配置
+	WSSettings  *utils.WSConfig  `json:"wsSettings"`  // net为ws时有效
+	H2Settings  *utils.H2Config  `json:"h2Settings"`  // net为h2时有效
+
+	GRPCSettings *utils.GRPCConfig `json:"grpcSettings"` // net为grpc时有效，没有设置serviceName时使用path
 }
 
 type Client struct {
 	dial   utils.Dialer
 	userid []byte
+	mux    *mux.Client
+
+	headerDelay time.Duration
 }
 
 // 解析JSON配置，初始化本地客户端
@@ -42,18 +61,48 @@ func NewClientFromBytes(buf []byte) (*Client, error) {
 func (client *Client) Protocol() utils.ProtocolType { return utils.ProtoVless }
 
 func (client *Client) parse(config *Config) error {
-	var err error
-	client.dial, err = utils.MakeDialer(config.Network, config.Address, config.Port, config.Path)
+	tlsConfig, err := utils.ParseTLS(config.Tls, config.TLSSettings)
+	if err != nil {
+		return err
+	}
+	client.dial, err = utils.MakeDialerWithConfig(&utils.DialConfig{
+		Network: config.Network,
+		Address: config.Address,
+		Port:    config.Port,
+		Path:    config.Path,
+		TLS:     tlsConfig,
+		WS:      utils.ParseWS(config.Host, config.WSSettings),
+		H2:      utils.ParseH2(config.Host, config.H2Settings),
+		GRPC:    utils.ParseGRPC(config.Host, config.Path, config.GRPCSettings),
+	})
 	if err != nil {
 		return err
 	}
 
-	client.userid, err = utils.ParseUUID(config.Id)
+	if config.Id == "" && config.Pass != "" {
+		client.userid = utils.UUIDFromPassword(config.Pass)
+	} else {
+		client.userid, err = utils.ParseUUID(config.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Mux > 0 {
+		client.mux = mux.NewClient(client.dialMux, config.Mux)
+	}
+	client.headerDelay = time.Duration(config.HeaderDelay) * time.Millisecond
 
-	return err
+	return nil
 }
 
+// 启用多路复用时，TCP连接会复用已有的服务端连接
 func (client *Client) Dial(network string, addrType byte, addrData []byte, port uint16) (net.Conn, error) {
+	if client.mux != nil {
+		t := utils.NewAddrType(utils.ProtoVless, addrType)
+		return client.mux.Dial(mux.NetworkTCP, t, addrData, port)
+	}
+
 	raw, err := client.Connect()
 	if err != nil {
 		log.Println("connect server failed:", err)
@@ -65,11 +114,56 @@ func (client *Client) Dial(network string, addrType byte, addrData []byte, port
 
 func (client *Client) Connect() (net.Conn, error) { return client.dial() }
 
+// 创建承载多路复用的连接，Mux指令不需要目标地址
+func (client *Client) dialMux() (net.Conn, error) {
+	raw, err := client.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.upgrade(raw, CommandMux, 0, nil, 0), nil
+}
+
 func (client *Client) Upgrade(c net.Conn, addrType byte, addrData []byte, port uint16) net.Conn {
-	return &ClientConn{
+	return client.upgrade(c, CommandTCP, addrType, addrData, port)
+}
+
+// 创建UDP会话，会话的目标地址在指令中确定
+func (client *Client) DialUDP(addrType byte, addrData []byte, port uint16) (*PacketConn, error) {
+	raw, err := client.Connect()
+	if err != nil {
+		log.Println("connect server failed:", err)
+		return nil, err
+	}
+
+	pc, err := client.UpgradeUDP(raw, addrType, addrData, port)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (client *Client) UpgradeUDP(c net.Conn, addrType byte, addrData []byte, port uint16) (*PacketConn, error) {
+	t := utils.NewAddrType(utils.ProtoVless, addrType)
+	addr, err := utils.AddrString(t, addrData, port)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := client.upgrade(c, CommandUDP, addrType, addrData, port)
+	return NewPacketConn(conn, utils.NewAddr("udp", addr)), nil
+}
+
+func (client *Client) upgrade(c net.Conn, command byte, addrType byte, addrData []byte, port uint16) *ClientConn {
+	conn := &ClientConn{
 		Client:  client,
 		Conn:    c,
-		command: NewCommand(client.userid, CommandTCP, addrType, addrData, port),
+		command: NewCommand(client.userid, command, addrType, addrData, port),
 		resp:    &Response{},
 	}
+	// Mux与UDP的数据由客户端先发送，不需要提前发送指令
+	if command == CommandTCP {
+		conn.scheduleFlush(client.headerDelay)
+	}
+	return conn
 }
@@ -1,8 +1,14 @@
 package vless
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
 )
 
 const (
@@ -18,22 +24,86 @@ type ClientConn struct {
 	command *Command
 	resp    *Response
 
+	wmu        sync.Mutex
+	herr       atomic.Pointer[utils.HandshakeError] // 握手失败后，后续的读写都返回该错误
+	timer      atomic.Pointer[time.Timer]
 	dataWriter io.Writer
 	dataReader io.Reader
 }
 
 func (c *ClientConn) Write(buf []byte) (int, error) {
-	if c.dataWriter == nil {
-		c.command.WriteTo(c.Conn)
-		c.dataWriter = c.Conn
-	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
 	return c.dataWriter.Write(buf)
 }
 
+// 立即发送指令，用于服务端先发送数据的协议（如SSH、SMTP）
+// 默认情况下指令与第一次写入的数据一起发送
+func (c *ClientConn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.flush()
+}
+
+// 根据配置安排指令的发送时机，参考Config.HeaderDelay
+func (c *ClientConn) scheduleFlush(delay time.Duration) {
+	switch {
+	case delay < 0:
+		c.Flush()
+	case delay > 0:
+		c.timer.Store(time.AfterFunc(delay, func() { c.Flush() }))
+	}
+}
+
+func (c *ClientConn) flush() error {
+	if herr := c.herr.Load(); herr != nil {
+		return herr
+	}
+	if c.dataWriter != nil {
+		return nil
+	}
+	if t := c.timer.Load(); t != nil {
+		t.Stop()
+	}
+
+	_, err := c.command.WriteTo(c.Conn)
+	if err != nil {
+		return c.fail(utils.NewHandshakeError(utils.ErrTransport, err))
+	}
+	c.dataWriter = c.Conn
+	return nil
+}
+
+// 记录第一次发生的握手错误
+func (c *ClientConn) fail(herr *utils.HandshakeError) error {
+	c.herr.CompareAndSwap(nil, herr)
+	return c.herr.Load()
+}
+
+func (c *ClientConn) Close() error {
+	if t := c.timer.Load(); t != nil {
+		t.Stop()
+	}
+	return c.Conn.Close()
+}
+
 func (c *ClientConn) Read(buf []byte) (int, error) {
+	if herr := c.herr.Load(); herr != nil {
+		return 0, herr
+	}
+
 	if c.dataReader == nil {
-		c.resp.ReadFrom(c.Conn)
+		_, err := c.resp.ReadFrom(c.Conn)
+		if err != nil {
+			return 0, c.fail(utils.NewResponseReadError(err))
+		}
+		if c.resp.Version() != c.command.Version() {
+			return 0, c.fail(utils.NewHandshakeError(utils.ErrResponseMismatch, errors.New("version not match")))
+		}
 		c.dataReader = c.Conn
 	}
 
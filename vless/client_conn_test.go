@@ -0,0 +1,85 @@
+package vless
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientConnHeaderDelay(t *testing.T) {
+	// 模拟服务端先发送数据的协议，如SMTP
+	greeting := "220 service ready\r\n"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(greeting))
+			c.Close()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+
+	var uuid [16]byte
+	sess, _ := NewSessionWithUsers(&User{ID: uuid})
+
+	for _, delay := range []time.Duration{-1, time.Millisecond * 50} {
+		t.Run(fmt.Sprintf("delay=%v", delay), func(t *testing.T) {
+			client := &Client{userid: uuid[:], headerDelay: delay}
+
+			c1, c2 := net.Pipe()
+			go sess.Process(c2)
+
+			conn := client.Upgrade(c1, utils.VlessAddrIPv4, addr.IP.To4(), uint16(addr.Port))
+			defer conn.Close()
+
+			// 没有写入任何数据，也能读取到服务端的数据
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			buf := make([]byte, len(greeting))
+			_, err := io.ReadFull(conn, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, greeting, string(buf))
+		})
+	}
+}
+
+func TestClientConnHandshakeError(t *testing.T) {
+	var uuid [16]byte
+	client := &Client{userid: uuid[:]}
+
+	// 服务端不认识该用户，直接关闭连接
+	sess, _ := NewSession("27848739-7e62-4138-9fd3-098a63964b6b")
+	sess.SetHandshakeTimeout(time.Millisecond * 100)
+	c1, c2 := net.Pipe()
+	go sess.Process(c2)
+	conn := client.Upgrade(c1, utils.VlessAddrDomain, []byte("localhost"), 80)
+	go conn.Write([]byte("hello"))
+	_, err := conn.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, utils.ErrAuthRejected)
+
+	// 之后连接不再可用
+	_, err2 := conn.Write([]byte("hello"))
+	assert.Equal(t, err, err2)
+
+	// 应答的版本与请求不一致
+	c1, c2 = net.Pipe()
+	go func() {
+		io.CopyN(io.Discard, c2, 1)
+		c2.Write([]byte{1, 0})
+	}()
+	conn = client.Upgrade(c1, utils.VlessAddrDomain, []byte("localhost"), 80)
+	go conn.Write([]byte("hello"))
+	_, err = conn.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, utils.ErrResponseMismatch)
+}
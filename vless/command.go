@@ -2,6 +2,7 @@ package vless
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 
 	"github.com/net-agent/protocol/utils"
@@ -10,6 +11,9 @@ import (
 const MinCommandSize = 1 + 16 + 1 + 0 + 1 + 2 + 1 + 1 + 0
 const MaxCommandSize = MinCommandSize + 255
 
+// Mux指令不携带Port与地址信息
+const muxCommandSize = 1 + 16 + 1 + 0 + 1
+
 type Command struct {
 	buf  [MaxCommandSize]byte
 	size int
@@ -22,6 +26,12 @@ func NewCommand(uuid []byte, cmd byte, addrType byte, addrData []byte, port uint
 	copy(c.buf[1:17], uuid[:])
 	c.buf[17] = 0
 	c.buf[18] = cmd
+
+	if cmd == CommandMux {
+		c.size = muxCommandSize
+		return c
+	}
+
 	binary.BigEndian.PutUint16(c.buf[19:21], port)
 	c.buf[21] = addrType
 
@@ -41,6 +51,7 @@ func NewCommand(uuid []byte, cmd byte, addrType byte, addrData []byte, port uint
 
 func (c *Command) Version() byte        { return c.buf[0] }
 func (c *Command) GetUUID() []byte      { return c.buf[1:17] }
+func (c *Command) GetCommand() byte     { return c.buf[18] }
 func (c *Command) Bytes() []byte        { return c.buf[:c.size] }
 func (c *Command) GetAddressType() byte { return c.buf[21] }
 func (c *Command) GetAddressSize() byte { return c.buf[22] }
@@ -56,7 +67,21 @@ func (c *Command) ReadFrom(r io.Reader) (int64, error) {
 	c.size = 0
 
 	readed := int64(0)
-	n, err := io.ReadFull(r, c.buf[:MinCommandSize])
+	n, err := io.ReadFull(r, c.buf[:muxCommandSize])
+	readed += int64(n)
+	c.size = int(readed)
+	if err != nil {
+		return readed, err
+	}
+	// 尽早拒绝非vless的数据（例如HTTP请求），避免等待读取完整的指令
+	if c.Version() != Version {
+		return readed, errors.New("invalid vless version")
+	}
+	if c.GetCommand() == CommandMux {
+		return readed, nil
+	}
+
+	n, err = io.ReadFull(r, c.buf[readed:MinCommandSize])
 	readed += int64(n)
 	c.size = int(readed)
 	if err != nil {
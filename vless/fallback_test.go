@@ -0,0 +1,55 @@
+package vless
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	sess, _ := NewSession("27848739-7e62-4138-9fd3-098a63964b6b")
+	sess.SetHandshakeTimeout(time.Millisecond * 100)
+	sess.SetFallbacks(&utils.Fallback{Path: "/site", Dest: l.Addr().String()})
+
+	// 认证失败的请求连同已经读取的数据一起转发给回落目标
+	c1, c2 := net.Pipe()
+	go sess.Process(c2)
+	req := []byte("GET /site HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	go c1.Write(req)
+	c1.SetDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, len(req))
+	_, err = io.ReadFull(c1, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, req, buf)
+	c1.Close()
+
+	// 没有匹配的回落目标时关闭连接
+	c1, c2 = net.Pipe()
+	errch := make(chan error, 1)
+	go func() { errch <- sess.Process(c2) }()
+	go c1.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	assert.NotNil(t, <-errch)
+	c1.Close()
+}
@@ -0,0 +1,138 @@
+package vless
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/net-agent/protocol/mux"
+	"github.com/net-agent/protocol/utils"
+)
+
+// 通过UUID匹配到用户后的vless请求
+type Request struct {
+	User    *User
+	Command byte   // CommandTCP/CommandUDP，Mux子连接按其网络类型给出
+	Addr    string // 目标地址
+	Mux     bool   // 是否为Mux会话中的子连接，此时UDP不使用长度前缀，每次Read/Write对应一个数据包
+
+	AddrType byte // VlessAddrXXX
+	AddrData []byte
+	Port     uint16
+}
+
+func newRequest(user *User, cmd *Command) (*Request, error) {
+	req := &Request{
+		User:    user,
+		Command: cmd.GetCommand(),
+	}
+	if req.Command != CommandMux {
+		req.AddrType = cmd.GetAddressType()
+		req.AddrData = cmd.GetAddressData()
+		req.Port = cmd.GetPort()
+
+		t := utils.NewAddrType(utils.ProtoVless, req.AddrType)
+		addr, err := utils.AddrString(t, req.AddrData, req.Port)
+		if err != nil {
+			return nil, err
+		}
+		req.Addr = addr
+	}
+	return req, nil
+}
+
+// 子连接的目标地址与网络类型来自Mux.Cool的New帧
+func newStreamRequest(user *User, st *mux.Stream) (*Request, error) {
+	t, addrData, port := st.Target()
+	addr, err := st.TargetString()
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{
+		User:     user,
+		Command:  CommandTCP,
+		Addr:     addr,
+		Mux:      true,
+		AddrType: t.Byte(utils.ProtoVless),
+		AddrData: addrData,
+		Port:     port,
+	}
+	if st.Network() == mux.NetworkUDP {
+		req.Command = CommandUDP
+	}
+	return req, nil
+}
+
+// vless请求的处理接口，Handle返回后连接会被关闭
+// 应答头部只有版本号与附加信息长度，在第一次写入数据或者调用conn.Accept时发送，
+// 在此之前返回错误，客户端读取应答时得到utils.ErrAuthRejected。
+// Mux会话中的每条子连接会单独调用一次Handle，req.Mux为true
+type Handler interface {
+	Handle(conn *ServerConn, req *Request) error
+}
+
+type HandlerFunc func(conn *ServerConn, req *Request) error
+
+func (f HandlerFunc) Handle(conn *ServerConn, req *Request) error { return f(conn, req) }
+
+// 交由handler处理，未设置时使用DialAndLink
+func (s *Session) handle(conn *ServerConn, req *Request) error {
+	if req.Command == CommandMux {
+		return s.serveMux(conn, req)
+	}
+	if s.handler != nil {
+		return s.handler.Handle(conn, req)
+	}
+	return s.DialAndLink(conn, req)
+}
+
+// 发送应答后在连接上处理Mux.Cool帧
+func (s *Session) serveMux(conn *ServerConn, req *Request) error {
+	if err := conn.Accept(); err != nil {
+		return err
+	}
+	return mux.Serve(conn, func(st *mux.Stream) error {
+		sub, err := newStreamRequest(req.User, st)
+		if err != nil {
+			return err
+		}
+		log.Printf("mux accepted. user='%v' target='%v'\n", sub.User, sub.Addr)
+		return s.handle(NewServerConn(st, sub.User), sub)
+	})
+}
+
+// 默认的请求处理：连接目标地址并双向转发
+func (s *Session) DialAndLink(conn *ServerConn, req *Request) error {
+	var target net.Conn
+	var err error
+	switch req.Command {
+	case CommandMux:
+		return s.serveMux(conn, req)
+	case CommandTCP:
+		target, err = utils.Dial(req.Addr)
+	case CommandUDP:
+		target, err = utils.DialUDP(req.Addr)
+	default:
+		return errors.New("invalid command, only tcp/udp/mux supported")
+	}
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if err := conn.Accept(); err != nil {
+		return err
+	}
+
+	if req.Command == CommandUDP {
+		var pc net.Conn = conn
+		if !req.Mux {
+			pc = NewPacketConn(conn, target.RemoteAddr())
+		}
+		utils.LinkPacketAndLog(req.Addr, target, pc, utils.DefaultPacketIdleTimeout)
+		return nil
+	}
+
+	utils.LinkAndLog(req.Addr, target, conn, s.idle)
+	return nil
+}
@@ -0,0 +1,113 @@
+package vless
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/mux"
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionHandler(t *testing.T) {
+	var uuid [16]byte
+	client := &Client{userid: uuid[:]}
+	user := &User{ID: uuid}
+	sess, _ := NewSessionWithUsers(user)
+
+	reqs := make(chan *Request, 1)
+	sess.SetHandler(HandlerFunc(func(conn *ServerConn, req *Request) error {
+		reqs <- req
+		if req.Addr != "echo.local:80" {
+			return errors.New("rejected")
+		}
+		_, err := io.Copy(conn, conn)
+		return err
+	}))
+
+	// 由handler代替连接目标地址
+	c1, c2 := net.Pipe()
+	go sess.Process(c2)
+	conn := client.Upgrade(c1, utils.VlessAddrDomain, []byte("echo.local"), 80)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	req := <-reqs
+	assert.Equal(t, CommandTCP, req.Command)
+	assert.Equal(t, user, req.User)
+
+	// handler在发送应答前返回错误，客户端视为拒绝
+	c1, c2 = net.Pipe()
+	go sess.Process(c2)
+	conn = client.Upgrade(c1, utils.VlessAddrDomain, []byte("other.local"), 80)
+	go conn.Write([]byte("hello"))
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, utils.ErrAuthRejected)
+	assert.Equal(t, "other.local:80", (<-reqs).Addr)
+}
+
+// Mux会话中的每条子连接单独交由handler处理
+func TestSessionMuxHandler(t *testing.T) {
+	var uuid [16]byte
+	user := &User{ID: uuid}
+	sess, _ := NewSessionWithUsers(user)
+	client := &Client{userid: uuid[:]}
+	client.dial = func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go sess.Process(c2)
+		return c1, nil
+	}
+	client.mux = mux.NewClient(client.dialMux, 1)
+
+	reqs := make(chan *Request, 2)
+	sess.SetHandler(HandlerFunc(func(conn *ServerConn, req *Request) error {
+		reqs <- req
+		if req.Addr != "echo.local:80" {
+			return errors.New("rejected")
+		}
+		_, err := io.Copy(conn, conn)
+		return err
+	}))
+
+	conn, err := client.Dial("tcp", utils.VlessAddrDomain, []byte("echo.local"), 80)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	req := <-reqs
+	assert.True(t, req.Mux)
+	assert.Equal(t, CommandTCP, req.Command)
+	assert.Equal(t, utils.VlessAddrDomain, req.AddrType)
+	assert.Equal(t, user, req.User)
+
+	// handler返回后子连接被关闭，不影响同一会话中的其它子连接
+	other, err := client.Dial("tcp", utils.VlessAddrDomain, []byte("other.local"), 80)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err = other.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "other.local:80", (<-reqs).Addr)
+
+	go conn.Write([]byte("world"))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf))
+}
@@ -0,0 +1,91 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/mux"
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandMux(t *testing.T) {
+	var uuid [16]byte
+	cmd := NewCommand(uuid[:], CommandMux, 0, nil, 0)
+	assert.Equal(t, 19, len(cmd.Bytes()))
+
+	cmd2 := &Command{}
+	_, err := cmd2.ReadFrom(bytes.NewReader(cmd.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, CommandMux, cmd2.GetCommand())
+	assert.Equal(t, cmd.Bytes(), cmd2.Bytes())
+}
+
+func TestSessionMux(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	echoAddr := l.Addr().(*net.TCPAddr)
+
+	var uuid [16]byte
+	sess, _ := NewSessionWithUsers(&User{ID: uuid})
+
+	var dialed int
+	client := &Client{userid: uuid[:]}
+	client.dial = func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		dialed++
+		go sess.Process(c2)
+		return c1, nil
+	}
+	client.mux = mux.NewClient(client.dialMux, 2)
+
+	conns := []net.Conn{}
+	for i := 0; i < 4; i++ {
+		c, err := client.Dial("tcp", utils.VlessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+		if !assert.Nil(t, err) {
+			return
+		}
+		conns = append(conns, c)
+	}
+	assert.Equal(t, 2, dialed)
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			defer c.Close()
+
+			payload := make([]byte, 32*1024)
+			rand.Read(payload)
+			go c.Write(payload)
+
+			buf := make([]byte, len(payload))
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			_, err := io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payload, buf))
+		}(c)
+	}
+	wg.Wait()
+}
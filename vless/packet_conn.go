@@ -0,0 +1,70 @@
+package vless
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const MaxPacketSize = 0xFFFF
+
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// VLESS的UDP模式：每个数据包以[Length 2B][Payload]的形式在流上传输
+// 会话的目标地址在指令中确定，所以WriteTo会忽略addr参数
+type PacketConn struct {
+	net.Conn
+	raddr net.Addr
+	rhead [2]byte
+}
+
+func NewPacketConn(c net.Conn, raddr net.Addr) *PacketConn {
+	return &PacketConn{Conn: c, raddr: raddr}
+}
+
+// 读取一个完整的数据包，buf长度不足时超出部分会被丢弃
+func (pc *PacketConn) Read(buf []byte) (int, error) {
+	_, err := io.ReadFull(pc.Conn, pc.rhead[:])
+	if err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(pc.rhead[:]))
+	if size <= len(buf) {
+		return io.ReadFull(pc.Conn, buf[:size])
+	}
+
+	n, err := io.ReadFull(pc.Conn, buf)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.CopyN(io.Discard, pc.Conn, int64(size-n))
+	return n, err
+}
+
+// 将buf作为一个独立的数据包写出，长度前缀与数据一次性写入
+func (pc *PacketConn) Write(buf []byte) (int, error) {
+	if len(buf) > MaxPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame[:2], uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	_, err := pc.Conn.Write(frame)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (pc *PacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, err := pc.Read(buf)
+	return n, pc.raddr, err
+}
+
+func (pc *PacketConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	return pc.Write(buf)
+}
@@ -0,0 +1,77 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionUDP(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := l.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			l.WriteTo(buf[:n], addr)
+		}
+	}()
+	echoAddr := l.LocalAddr().(*net.UDPAddr)
+
+	var uuid [16]byte
+	client := &Client{userid: uuid[:]}
+	sess, _ := NewSessionWithUsers(&User{ID: uuid})
+
+	c1, c2 := net.Pipe()
+	go sess.Process(c2)
+
+	pc, err := client.UpgradeUDP(c1, utils.VlessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(time.Second * 5))
+
+	for _, size := range []int{1, 100, 1400, 8192} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+
+		// net.Pipe没有缓冲，写入需要与读取并发进行
+		go func() {
+			_, err := pc.Write(payload)
+			assert.Nil(t, err)
+		}()
+
+		buf := make([]byte, MaxPacketSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.True(t, bytes.Equal(payload, buf[:n]))
+		assert.Equal(t, echoAddr.String(), addr.String())
+	}
+
+	// 缓冲区不足时，数据包被截断，但不影响后续数据包的边界
+	go pc.Write([]byte("hello world"))
+	buf := make([]byte, 5)
+	n, err := pc.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	go pc.Write([]byte("next"))
+	buf = make([]byte, 100)
+	n, err = pc.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "next", string(buf[:n]))
+}
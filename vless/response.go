@@ -25,6 +25,7 @@ type Response struct {
 }
 
 func (resp *Response) Bytes() []byte { return resp.buf[:resp.size] }
+func (resp *Response) Version() byte { return resp.buf[0] }
 
 func (resp *Response) ReadFrom(r io.Reader) (int64, error) {
 	resp.size = 0
@@ -2,59 +2,201 @@ package vless
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/net-agent/protocol/utils"
 )
 
 func NewSession(id string) (*Session, error) {
-	sess := &Session{}
-	uuid, err := utils.ParseUUID(id)
+	u, err := NewUser(id, "")
 	if err != nil {
 		return nil, err
 	}
-	copy(sess.uuid[:], uuid)
+	return NewSessionWithUsers(u)
+}
+
+func NewSessionWithUsers(users ...*User) (*Session, error) {
+	sess := &Session{
+		idle:             utils.DefaultIdleTimeout,
+		handshakeTimeout: utils.DefaultHandshakeTimeout,
+	}
+	for _, u := range users {
+		if err := sess.AddUser(u); err != nil {
+			return nil, err
+		}
+	}
 	return sess, nil
 }
 
 type Session struct {
-	uuid [16]byte
+	mu      sync.RWMutex
+	users   []*User // 写时复制，读取时无需长时间持有锁
+	idle    time.Duration
+	handler Handler
+
+	handshakeTimeout time.Duration
+	fallbacks        utils.Fallbacks
+}
+
+// 设置读取指令的超时时间，默认为utils.DefaultHandshakeTimeout
+// 0表示不限制，此时握手失败后立即关闭连接
+func (s *Session) SetHandshakeTimeout(d time.Duration) { s.handshakeTimeout = d }
+
+// 设置认证失败时的回落目标，参考utils.Fallbacks
+func (s *Session) SetFallbacks(fbs ...*utils.Fallback) { s.fallbacks = fbs }
+
+// 握手失败的处理：优先转发到匹配的回落目标，
+// 否则在超时前读取并丢弃随机长度的数据，参考utils.DrainConn
+func (s *Session) reject(c net.Conn, peek *utils.PeekConn, err error) error {
+	if peek != nil {
+		if ok, ferr := s.fallbacks.Serve(peek, s.idle); ok {
+			return ferr
+		}
+	}
+	if s.handshakeTimeout > 0 {
+		utils.DrainConn(c)
+	}
+	return err
+}
+
+// 设置请求的处理方式，传入nil时使用DialAndLink
+func (s *Session) SetHandler(h Handler) { s.handler = h }
+
+// 设置TCP转发的空闲超时时间，0表示不限制
+func (s *Session) SetIdleTimeout(d time.Duration) { s.idle = d }
+
+func (s *Session) AddUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, exist := range s.users {
+		if exist.ID == u.ID {
+			return ErrUserExists
+		}
+	}
+
+	users := make([]*User, 0, len(s.users)+1)
+	users = append(users, s.users...)
+	s.users = append(users, u)
+	return nil
+}
+
+func (s *Session) RemoveUser(id string) error {
+	userid, err := utils.ParseUUID(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, u := range s.users {
+		if bytes.Equal(u.ID[:], userid) {
+			users := make([]*User, 0, len(s.users)-1)
+			users = append(users, s.users[:i]...)
+			s.users = append(users, s.users[i+1:]...)
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+func (s *Session) Users() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*User{}, s.users...)
+}
+
+// 查找uuid对应的用户
+// 遍历全部用户并使用常量时间比较，耗时与命中的位置无关
+func (s *Session) FindUser(id []byte) (*User, error) {
+	s.mu.RLock()
+	users := s.users
+	s.mu.RUnlock()
+
+	var found *User
+	for _, u := range users {
+		if subtle.ConstantTimeCompare(u.ID[:], id) == 1 {
+			found = u
+		}
+	}
+	if found == nil {
+		return nil, ErrUserNotFound
+	}
+	if !found.Enabled() {
+		return nil, ErrUserDisabled
+	}
+	return found, nil
 }
 
 func (s *Session) Process(c net.Conn) error {
 	defer c.Close()
 	var err error
 
-	cmd := &Command{}
-	_, err = cmd.ReadFrom(c)
-	if err != nil {
-		return err
+	if s.handshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.handshakeTimeout))
 	}
-	if !bytes.Equal(cmd.GetUUID(), s.uuid[:]) {
-		return errors.New("invalid uuid")
+
+	// 配置了回落时记录握手阶段读取的数据
+	r := io.Reader(c)
+	var peek *utils.PeekConn
+	if len(s.fallbacks) > 0 {
+		peek = utils.NewPeekConn(c, nil)
+		r = peek
 	}
 
-	t := utils.NewAddrType(utils.ProtoVless, cmd.GetAddressType())
-	addr, err := utils.AddrString(t, cmd.GetAddressData(), cmd.GetPort())
+	cmd := &Command{}
+	_, err = cmd.ReadFrom(r)
 	if err != nil {
-		return err
+		return s.reject(c, peek, err)
+	}
+	user, err := s.FindUser(cmd.GetUUID())
+	if err != nil {
+		return s.reject(c, peek, err)
 	}
+	c.SetDeadline(time.Time{})
 
-	log.Printf("accepted. target='%v'\n", addr)
+	switch cmd.GetCommand() {
+	case CommandTCP, CommandUDP, CommandMux:
+	default:
+		return errors.New("invalid command, only tcp/udp/mux supported")
+	}
 
-	target, err := utils.Dial(addr)
+	req, err := newRequest(user, cmd)
 	if err != nil {
 		return err
 	}
-	defer target.Close()
+	if req.Command == CommandMux {
+		log.Printf("accepted. user='%v' mux\n", user)
+	} else {
+		log.Printf("accepted. user='%v' target='%v'\n", user, req.Addr)
+	}
 
-	_, err = NewResponse(cmd.Version(), nil).WriteTo(c)
-	if err != nil {
+	client := NewServerConn(c, user)
+	client.respond = func() error {
+		_, err := NewResponse(cmd.Version(), nil).WriteTo(c)
 		return err
 	}
 
-	utils.LinkAndLog(addr, target, c)
-	return nil
+	return s.handle(client, req)
+}
+
+// 在监听上处理vless连接，连接管理参考utils.Server
+type Server struct {
+	*utils.Server
+	Session *Session
+}
+
+// maxConns为同时处理的最大连接数，0表示不限制
+func NewServer(s *Session, maxConns int) *Server {
+	return &Server{
+		Server:  utils.NewServer(s.Process, maxConns),
+		Session: s,
+	}
 }
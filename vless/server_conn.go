@@ -0,0 +1,50 @@
+package vless
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// 服务端已通过认证的连接，携带匹配到的用户信息
+type ServerConn struct {
+	net.Conn
+	User *User
+
+	respond    func() error // 发送应答头部，由Session设置
+	acceptOnce sync.Once
+	acceptErr  error
+}
+
+func NewServerConn(c net.Conn, user *User) *ServerConn {
+	return &ServerConn{Conn: c, User: user}
+}
+
+// 发送应答头部，只会执行一次
+// 第一次写入数据时会自动调用
+func (c *ServerConn) Accept() error {
+	c.acceptOnce.Do(func() {
+		if c.respond != nil {
+			c.acceptErr = c.respond()
+		}
+	})
+	return c.acceptErr
+}
+
+func (c *ServerConn) Write(buf []byte) (int, error) {
+	if err := c.Accept(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(buf)
+}
+
+// 关闭底层连接的写方向（需要底层连接支持）
+func (c *ServerConn) CloseWrite() error {
+	if err := c.Accept(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
+}
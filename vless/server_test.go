@@ -32,8 +32,7 @@ func TestServer(t *testing.T) {
 	}
 
 	// init server
-	sess := &Session{}
-	copy(sess.uuid[:], uuid[:])
+	sess, _ := NewSessionWithUsers(&User{ID: uuid})
 
 	// server loop
 	go func() {
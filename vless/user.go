@@ -0,0 +1,52 @@
+package vless
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/net-agent/protocol/utils"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserDisabled = errors.New("user disabled")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// 服务端的用户信息
+type User struct {
+	ID    [16]byte
+	Email string
+	Level byte
+
+	disabled atomic.Bool
+}
+
+func NewUser(id, email string) (*User, error) {
+	userid, err := utils.ParseUUID(id)
+	if err != nil {
+		return nil, err
+	}
+	u := &User{Email: email}
+	copy(u.ID[:], userid)
+	return u, nil
+}
+
+// 使用密码生成UUID，便于分发容易记忆的凭证
+func NewUserFromPassword(password, email string) *User {
+	u := &User{Email: email}
+	copy(u.ID[:], utils.UUIDFromPassword(password))
+	return u
+}
+
+// 用于日志输出，没有设置Email时使用uuid
+func (u *User) String() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return uuid.UUID(u.ID).String()
+}
+
+func (u *User) Enabled() bool           { return !u.disabled.Load() }
+func (u *User) SetEnabled(enabled bool) { u.disabled.Store(!enabled) }
@@ -0,0 +1,48 @@
+package vless
+
+import (
+	"testing"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUUIDFromPassword(t *testing.T) {
+	// 与Xray的映射结果一致
+	u := NewUserFromPassword("example", "")
+	assert.Equal(t, "feb54431-301b-52bb-a6dd-e1e93e81bb9e", u.String())
+	assert.Equal(t, utils.UUIDFromPassword("example"), u.ID[:])
+}
+
+func TestSessionFindUser(t *testing.T) {
+	u1, err := NewUser("b831381d-6324-4d53-ad4f-8cda48b30811", "u1@test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	u2 := NewUserFromPassword("password", "u2@test")
+
+	sess, err := NewSessionWithUsers(u1, u2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, ErrUserExists, sess.AddUser(u2))
+	assert.Equal(t, 2, len(sess.Users()))
+
+	found, err := sess.FindUser(u2.ID[:])
+	assert.Nil(t, err)
+	assert.Equal(t, u2, found)
+
+	var unknown [16]byte
+	_, err = sess.FindUser(unknown[:])
+	assert.Equal(t, ErrUserNotFound, err)
+
+	u2.SetEnabled(false)
+	_, err = sess.FindUser(u2.ID[:])
+	assert.Equal(t, ErrUserDisabled, err)
+	u2.SetEnabled(true)
+
+	assert.Nil(t, sess.RemoveUser("b831381d-6324-4d53-ad4f-8cda48b30811"))
+	_, err = sess.FindUser(u1.ID[:])
+	assert.Equal(t, ErrUserNotFound, err)
+	assert.Equal(t, ErrUserNotFound, sess.RemoveUser("b831381d-6324-4d53-ad4f-8cda48b30811"))
+}
@@ -0,0 +1,40 @@
+package vmess
+
+import (
+	"io"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+// 客户端使用的账户信息
+type account struct {
+	userid   []byte
+	cmdKey   [16]byte
+	alterIds [][]byte // 不为空时使用旧版认证
+}
+
+func newAccount(userid []byte, alterId int) *account {
+	a := &account{userid: userid}
+	copy(a.cmdKey[:], GenCmdKey(userid))
+	a.alterIds = NewAlterIDs(userid, alterId)
+	return a
+}
+
+func (a *account) isLegacy() bool { return len(a.alterIds) > 0 }
+
+// 旧版认证从派生的id中随机选取一个
+func (a *account) pickAlterID(r io.Reader) []byte {
+	return a.alterIds[randIntn(r, len(a.alterIds))]
+}
+
+// 服务端通过动态端口指令下发的临时账户
+type switchedAccount struct {
+	*account
+	dial   utils.Dialer
+	expire time.Time
+}
+
+func (sa *switchedAccount) valid(now time.Time) bool {
+	return sa != nil && now.Before(sa.expire)
+}
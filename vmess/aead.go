@@ -2,17 +2,11 @@ package vmess
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/binary"
 	"io"
-	mrand "math/rand"
 	"time"
 )
 
-func init() {
-	mrand.Seed(time.Now().UnixNano())
-}
-
 const (
 	aeadTagSize          = int(16)
 	AeadKeyOfHeaderLen   = "VMess Header AEAD Key_Length"
@@ -26,8 +20,13 @@ const (
 )
 
 func SealAeadHeader(w io.Writer, cmdKey [16]byte, plainHeader []byte) error {
+	return SealAeadHeaderWithRand(w, nil, cmdKey, plainHeader)
+}
+
+// 使用指定的随机数来源生成EAuId与Nonce，r为nil时使用crypto/rand
+func SealAeadHeaderWithRand(w io.Writer, r io.Reader, cmdKey [16]byte, plainHeader []byte) error {
 	// EAuID
-	authidBuf, err := GenEAuId(cmdKey[:], time.Now().Unix(), mrand.Int())
+	authidBuf, err := GenEAuId(cmdKey[:], time.Now().Unix(), randIntn(r, 1<<31))
 	if err != nil {
 		return err
 	}
@@ -35,7 +34,7 @@ func SealAeadHeader(w io.Writer, cmdKey [16]byte, plainHeader []byte) error {
 
 	// Nonce
 	nonceBuf := make([]byte, 8)
-	_, err = io.ReadFull(rand.Reader, nonceBuf)
+	_, err = io.ReadFull(randReader(r), nonceBuf)
 	if err != nil {
 		return err
 	}
@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"math/rand"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -23,6 +22,7 @@ func NewChunkWithCommand(cmd *Command, isClient, isWriter bool) *Chunk {
 	isServer := !isClient
 	isReader := !isWriter
 	c := NewChunk()
+	c.rand = cmd.rand
 
 	// 是否已经启动：元数据混淆
 	// 元数据混淆有两个级别：
@@ -54,6 +54,16 @@ func NewChunkWithCommand(cmd *Command, isClient, isWriter bool) *Chunk {
 		}
 
 		if makeAead != nil {
+			// 长度字段使用独立的AEAD加密，key由数据key派生
+			if cmd.HashOption(OptionA) {
+				makeLenKey := func(key []byte) []byte { return makeKey(GenKDF16Key(key, "auth_len")) }
+				if (isClient && isWriter) || (isServer && isReader) {
+					c.EnableAuthLength(makeAead, makeLenKey(cmd.GetRequestCipherKey()), cmd.GetRequestCipherIV(), isWriter)
+				} else {
+					c.EnableAuthLength(makeAead, makeLenKey(cmd.GetResponseCipherKey()), cmd.GetResponseCipherIV(), isWriter)
+				}
+			}
+
 			if isClient {
 				if isWriter {
 					c.encryptor = GenChunkEncryptor(makeAead, makeKey(cmd.GetRequestCipherKey()), cmd.GetRequestCipherIV())
@@ -89,12 +99,16 @@ type Chunk struct {
 
 	mask, padding bool
 	shaker        *Shaker
+	rand          io.Reader // 生成padding内容，为nil时使用crypto/rand
 
 	encryptor ChunkEncryptor
 	decryptor ChunkDecryptor
+
+	lengthEncryptor ChunkEncryptor
+	lengthDecryptor ChunkDecryptor
 }
 type chunkBuffers struct {
-	meta    []byte // 2B
+	meta    []byte // 2B，启用长度认证时为18B
 	fnvSum  []byte // 4B
 	data    []byte
 	padding []byte
@@ -111,6 +125,18 @@ func (c *Chunk) EnableMask(shakeKey []byte, padding bool) *Chunk {
 	return c
 }
 
+// 启用长度认证：长度字段使用AEAD加密，被篡改时读取会失败
+// 启用后长度不再与mask进行异或，但padding长度仍由mask生成
+func (c *Chunk) EnableAuthLength(createAead AeadCreator, key, iv []byte, isWriter bool) *Chunk {
+	if isWriter {
+		c.lengthEncryptor = GenChunkEncryptor(createAead, key, iv)
+	} else {
+		c.lengthDecryptor = GenChunkDecryptor(createAead, key, iv)
+	}
+	c.bufs.meta = make([]byte, 2+aeadTagSize)
+	return c
+}
+
 // 启用数据前置fnv校验和
 func (c *Chunk) EnableFnvSum() *Chunk {
 	c.bufs.fnvSum = make([]byte, 4)
@@ -165,6 +191,7 @@ func (c *Chunk) SetData(data []byte) *Chunk {
 // 设置meta信息
 // * 不启用mask时，meta为数据长度L
 // * 启用mask时，meta为(L ^ nextShakeUint16)
+// * 启用长度认证时，meta为AEAD加密后的(L - 16)
 //
 // * 正常情况下 L = len(data)
 // * 启用aes-cfb情况下 L = len(data) + 4
@@ -177,15 +204,20 @@ func (c *Chunk) setMeta(data []byte) {
 	if c.encryptor != nil {
 		meta += 16 // size of gcm tag
 	}
+	if c.mask && c.padding {
+		padSize := c.shaker.NextUint16() % MaxPadSize
+		c.bufs.padding = c.bufs.padding[:padSize] // 重复使用padding的内存
+		meta += padSize
+	}
+	if c.lengthEncryptor != nil {
+		var plain [2]byte
+		binary.BigEndian.PutUint16(plain[:], meta-uint16(aeadTagSize))
+		c.bufs.meta = c.lengthEncryptor(plain[:])
+		return
+	}
 	if c.mask {
-		padSize := uint16(0)
-		if c.padding {
-			padSize = c.shaker.NextUint16() % MaxPadSize
-			c.bufs.padding = c.bufs.padding[:padSize] // 重复使用padding的内存
-			meta += padSize
-		}
 		mask := c.shaker.NextUint16()
-		// log.Printf("encode: size=%v mask=%v pad=%v meta=%v\n", meta, mask, padSize, meta^mask)
+		// log.Printf("encode: size=%v mask=%v meta=%v\n", meta, mask, meta^mask)
 
 		meta ^= mask
 	}
@@ -205,7 +237,7 @@ func (c *Chunk) setPadding() {
 	if !c.mask || !c.padding {
 		return
 	}
-	rand.Read(c.bufs.padding)
+	readRandom(c.rand, c.bufs.padding)
 }
 
 func (c *Chunk) ReadFrom(r io.Reader) (int64, error) {
@@ -217,7 +249,10 @@ func (c *Chunk) ReadFrom(r io.Reader) (int64, error) {
 	if err != nil {
 		return readed, err
 	}
-	dataSize, padSize := c.parseMeta()
+	dataSize, padSize, err := c.parseMeta()
+	if err != nil {
+		return readed, err
+	}
 
 	// 第二步：读取校验和字段（如果有）
 	if c.bufs.fnvSum != nil {
@@ -258,23 +293,33 @@ func (c *Chunk) ReadFrom(r io.Reader) (int64, error) {
 	return readed, nil
 }
 
-func (c *Chunk) parseMeta() (dataSize, padSize uint16) {
-	meta := binary.BigEndian.Uint16(c.bufs.meta[:2])
-	dataSize = meta
+func (c *Chunk) parseMeta() (dataSize, padSize uint16, err error) {
+	if c.mask && c.padding {
+		padSize = c.shaker.NextUint16() % MaxPadSize
+	}
 
-	if c.mask {
-		if c.padding {
-			padSize = c.shaker.NextUint16() % MaxPadSize
+	var total uint16
+	if c.lengthDecryptor != nil {
+		plain, err := c.lengthDecryptor(c.bufs.meta)
+		if err != nil {
+			return 0, 0, errors.New("invalid chunk length")
+		}
+		total = binary.BigEndian.Uint16(plain) + uint16(aeadTagSize)
+	} else {
+		total = binary.BigEndian.Uint16(c.bufs.meta[:2])
+		if c.mask {
+			total ^= c.shaker.NextUint16()
 		}
-		mask := c.shaker.NextUint16()
-
-		total := meta ^ mask
-		dataSize = total - padSize
 	}
 
+	overhead := padSize
 	if c.bufs.fnvSum != nil {
-		dataSize -= 4
+		overhead += 4
+	}
+	if total < overhead {
+		return 0, 0, errors.New("invalid chunk length")
 	}
+	dataSize = total - overhead
 
-	return
+	return dataSize, padSize, nil
 }
@@ -154,3 +154,52 @@ func testReadWriteCloser(t *testing.T, c1, c2 io.ReadWriteCloser) {
 		t.Error("wait done timeout")
 	}
 }
+
+func TestChunkAuthLength(t *testing.T) {
+	key := GenRandomBytes(16)
+	iv := GenRandomBytes(16)
+	createChunk := func(isWriter bool) *Chunk {
+		c := NewChunk().EnableMask(iv, true)
+		return c.EnableAuthLength(GenAesGcmAead, key, iv, isWriter)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := createChunk(true)
+	for _, size := range []int{0, 1, 100, MaxDataSize} {
+		_, err := w.SetData(GenRandomBytes(size)).WriteTo(buf)
+		assert.Nil(t, err)
+	}
+
+	r := createChunk(false)
+	for _, size := range []int{0, 1, 100, MaxDataSize} {
+		_, err := r.ReadFrom(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, size, r.DataSize())
+	}
+
+	// 长度被篡改时读取失败，而不是按错误的长度继续读取
+	buf.Reset()
+	w = createChunk(true)
+	w.SetData([]byte("hello")).WriteTo(buf)
+	data := buf.Bytes()
+	data[1] ^= 0x01
+	_, err := createChunk(false).ReadFrom(bytes.NewReader(data))
+	assert.Equal(t, "invalid chunk length", err.Error())
+}
+
+func TestChunkEOF(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := NewChunkWriter(buf, NewChunk().EnableFnvSum())
+	w.Write([]byte("hello"))
+	w.Write(nil) // 空的写入不产生chunk
+	assert.Nil(t, w.WriteEOF())
+
+	r := NewChunkReader(buf, NewChunk().EnableFnvSum())
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	n, err := r.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
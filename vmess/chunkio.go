@@ -36,9 +36,14 @@ type ChunkReader struct {
 
 	cache       *Chunk
 	cacheReaded int
+	eof         bool
 }
 
 func (cr *ChunkReader) Read(buf []byte) (nn int, ee error) {
+	if cr.eof {
+		return 0, io.EOF
+	}
+
 	// 判断是否所有的缓存数据都已经被读取过了
 	if cr.cacheReaded >= cr.cache.DataSize() {
 		cr.cacheReaded = 0
@@ -46,6 +51,12 @@ func (cr *ChunkReader) Read(buf []byte) (nn int, ee error) {
 		if err != nil {
 			return 0, err
 		}
+
+		// 数据长度为0的chunk表示对端结束发送
+		if cr.cache.DataSize() == 0 {
+			cr.eof = true
+			return 0, io.EOF
+		}
 	}
 
 	// 将部分数据拷贝到目标区域中，完成一次Read
@@ -63,9 +74,18 @@ type ChunkWriter struct {
 }
 
 func (cw *ChunkWriter) Write(buf []byte) (nn int, ee error) {
+	// 空的chunk表示结束发送，不能由普通的写入产生
+	if len(buf) == 0 {
+		return 0, nil
+	}
 	return WriteAll(cw.safeWriteFrame, buf, MaxDataSize)
 }
 
+// 发送数据长度为0的chunk，通知对端数据已经发送完毕
+func (cw *ChunkWriter) WriteEOF() error {
+	return cw.safeWriteFrame(nil)
+}
+
 func (cw *ChunkWriter) safeWriteFrame(buf []byte) error {
 	_, err := cw.chunk.SetData(buf).WriteTo(cw.raw)
 	return err
@@ -2,10 +2,15 @@ package vmess
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
+	"github.com/net-agent/protocol/mux"
 	"github.com/net-agent/protocol/utils"
 )
 
@@ -29,24 +34,64 @@ func NewConfig() *Config {
 
 type Config struct {
 	Version   byte   `json:"v"`
-	Network   string `json:"net"`       // ws/wss/tcp
+	Network   string `json:"net"`       // ws/wss/tcp/h2/grpc
 	Address   string `json:"add"`       // e.g. 127.0.0.1 / baidu.com
 	Port      uint16 `json:"port"`      // e.g. 80/443/...
 	Path      string `json:"path"`      // e.g. /download/abc
+	Host      string `json:"host"`      // ws/h2的Host请求头，grpc的:authority
 	Id        string `json:"id"`        // uuid
-	Security  string `json:"security"`  // none/auto/aes-128-cfb/aes-128-gcm/chacha20-poly1305
-	Transport string `json:"transport"` // stream/chunk/mask/padding
-	Tls       string `json:"tls"`
+	Security  string `json:"security"`  // none/zero/auto/aes-128-cfb/aes-128-gcm/chacha20-poly1305
+	Transport string `json:"transport"` // stream/chunk/mask/padding/auth-length
+	Tls       string `json:"tls"`       // tls/none
+	Mux       int    `json:"mux"`       // 单条连接上的最大子连接数，0表示不启用多路复用
+	Aid       int    `json:"aid"`       // alterId，大于0时使用旧版认证
+
+	// 指令的发送时机（毫秒）：0表示与第一次写入的数据一起发送，
+	// 小于0表示Upgrade时立即发送，大于0表示等待一段时间没有写入时单独发送
+	HeaderDelay int `json:"headerDelay"`
+
+	TLSSettings *utils.TLSConfig `json:"tlsSettings"` // tls为"tls"时有效，为空时使用默认配置
+	WSSettings  *utils.WSConfig  `json:"wsSettings"`  // net为ws时有效
+	H2Settings  *utils.H2Config  `json:"h2Settings"`  // net为h2时有效
+
+	GRPCSettings *utils.GRPCConfig `json:"grpcSettings"` // net为grpc时有效，没有设置serviceName时使用path
+}
+
+// 连接服务端的配置，动态端口时使用服务端下发的地址与端口
+func (config *Config) dialConfig(host string, port uint16) (*utils.DialConfig, error) {
+	tlsConfig, err := utils.ParseTLS(config.Tls, config.TLSSettings)
+	if err != nil {
+		return nil, err
+	}
+	return &utils.DialConfig{
+		Network: config.Network,
+		Address: host,
+		Port:    port,
+		Path:    config.Path,
+		TLS:     tlsConfig,
+		WS:      utils.ParseWS(config.Host, config.WSSettings),
+		H2:      utils.ParseH2(config.Host, config.H2Settings),
+		GRPC:    utils.ParseGRPC(config.Host, config.Path, config.GRPCSettings),
+	}, nil
 }
 
 type Client struct {
+	config  *Config
 	dial    utils.Dialer
-	userid  []byte
-	cmdKey  [16]byte
+	account *account
 	secType byte
 	option  byte
+	mux     *mux.Client
+	rand    io.Reader
+
+	headerDelay time.Duration
+
+	switched atomic.Pointer[switchedAccount]
 }
 
+// 替换随机数来源，默认使用crypto/rand，仅用于测试
+func (client *Client) SetRand(r io.Reader) { client.rand = r }
+
 func NewClientFromBytes(buf []byte) (*Client, error) {
 	cfg, err := NewConfigFromBytes(buf)
 	if err != nil {
@@ -64,17 +109,25 @@ func NewClientFromBytes(buf []byte) (*Client, error) {
 func (client *Client) parse(config *Config) error {
 	var err error
 
-	client.dial, err = utils.MakeDialer(config.Network, config.Address, config.Port, config.Path)
+	client.config = config
+	dialConfig, err := config.dialConfig(config.Address, config.Port)
+	if err != nil {
+		return err
+	}
+	client.dial, err = utils.MakeDialerWithConfig(dialConfig)
 	if err != nil {
 		return err
 	}
 
 	// 解析用户标识
-	client.userid, err = utils.ParseUUID(config.Id)
+	userid, err := utils.ParseUUID(config.Id)
 	if err != nil {
 		return err
 	}
-	copy(client.cmdKey[:], GenCmdKey(client.userid))
+	if config.Aid < 0 || config.Aid > 0xFFFF {
+		return fmt.Errorf("aid='%v' out of range", config.Aid)
+	}
+	client.account = newAccount(userid, config.Aid)
 
 	// 解析加密方式
 	switch config.Security {
@@ -88,15 +141,22 @@ func (client *Client) parse(config *Config) error {
 		client.secType = SecTypeAES128GCM
 	case "none":
 		client.secType = SecTypeNone
+	case "zero":
+		client.secType = SecTypeZero
 	default:
 		return fmt.Errorf("security='%v' not supported", config.Security)
 	}
 
 	// 解析传输Option参数
-	switch config.Transport {
+	// zero模式下数据不分块，transport配置无效
+	transport := config.Transport
+	if client.secType == SecTypeZero {
+		transport = "stream"
+	}
+	switch transport {
 	case "stream":
 		client.option = 0
-		if (client.secType != SecTypeNone) && (client.secType != SecTypeAES128CFB) {
+		if (client.secType != SecTypeNone) && (client.secType != SecTypeAES128CFB) && (client.secType != SecTypeZero) {
 			return fmt.Errorf("invalid config pair, transport='%v' and security='%v'", config.Transport, config.Security)
 		}
 	case "chunk":
@@ -108,37 +168,159 @@ func (client *Client) parse(config *Config) error {
 		if (client.secType != SecTypeAES128GCM) && (client.secType != SecTypeChaCha20Poly1305) {
 			return fmt.Errorf("invalid config pair, transport='%v' and security='%v'", config.Transport, config.Security)
 		}
+	case "auth-length":
+		client.option = OptionS | OptionM | OptionP | OptionA
+		if (client.secType != SecTypeAES128GCM) && (client.secType != SecTypeChaCha20Poly1305) {
+			return fmt.Errorf("invalid config pair, transport='%v' and security='%v'", config.Transport, config.Security)
+		}
 	default:
 		return fmt.Errorf("transport='%v' not supported", config.Transport)
 	}
 
+	if config.Mux > 0 {
+		client.mux = mux.NewClient(client.dialMux, config.Mux)
+	}
+	client.headerDelay = time.Duration(config.HeaderDelay) * time.Millisecond
+
 	return nil
 }
 
 func (client *Client) Protocol() utils.ProtocolType { return utils.ProtoVmess }
 
 // 根据配置，创建与服务端的连接
+// 启用多路复用时，TCP连接会复用已有的服务端连接
 func (client *Client) Dial(network string, addrType byte, addrData []byte, port uint16) (net.Conn, error) {
-	raw, err := client.Connect()
+	if client.mux != nil {
+		t := utils.NewAddrType(utils.ProtoVmess, addrType)
+		return client.mux.Dial(mux.NetworkTCP, t, addrData, port)
+	}
+
+	dial, acc := client.current()
+	raw, err := dial()
 	if err != nil {
 		log.Println("connect server failed: ", err)
 		return nil, err
 	}
 
-	return client.Upgrade(raw, addrType, addrData, port), nil
+	return client.upgrade(raw, acc, CmdTCP, addrType, addrData, port), nil
 }
 
 func (client *Client) Connect() (net.Conn, error) { return client.dial() }
 
+// 服务端下发的临时账户在有效期内优先使用
+func (client *Client) current() (utils.Dialer, *account) {
+	if sa := client.switched.Load(); sa.valid(time.Now()) {
+		return sa.dial, sa.account
+	}
+	return client.dial, client.account
+}
+
+// 处理服务端下发的动态端口指令
+func (client *Client) switchAccount(cmd *SwitchAccount) error {
+	host := cmd.Host
+	if host == "" {
+		host = client.config.Address
+	}
+	dialConfig, err := client.config.dialConfig(host, cmd.Port)
+	if err != nil {
+		return err
+	}
+	dial, err := utils.MakeDialerWithConfig(dialConfig)
+	if err != nil {
+		return err
+	}
+
+	client.switched.Store(&switchedAccount{
+		account: newAccount(cmd.ID, int(cmd.AlterIds)),
+		dial:    dial,
+		expire:  time.Now().Add(time.Duration(cmd.ValidMin) * time.Minute),
+	})
+	return nil
+}
+
+// 创建承载多路复用的连接，Mux指令不需要目标地址
+func (client *Client) dialMux() (net.Conn, error) {
+	dial, acc := client.current()
+	raw, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return client.upgrade(raw, acc, CmdMux, 0, nil, 0), nil
+}
+
+// 在已经建立的连接上升级协议，使用配置中的账户
 func (client *Client) Upgrade(c net.Conn, addrType byte, addrData []byte, port uint16) net.Conn {
-	return &ClientConn{
-		Client: client,
-		Conn:   c,
-		command: NewCommand(
-			CmdTCP,
-			client.option,
-			client.secType,
-			addrType, addrData, port,
-		),
+	return client.upgrade(c, client.account, CmdTCP, addrType, addrData, port)
+}
+
+// 创建UDP会话，会话的目标地址在指令中确定
+func (client *Client) DialUDP(addrType byte, addrData []byte, port uint16) (*PacketConn, error) {
+	dial, acc := client.current()
+	raw, err := dial()
+	if err != nil {
+		log.Println("connect server failed: ", err)
+		return nil, err
 	}
+
+	pc, err := client.upgradeUDP(raw, acc, addrType, addrData, port)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (client *Client) UpgradeUDP(c net.Conn, addrType byte, addrData []byte, port uint16) (*PacketConn, error) {
+	return client.upgradeUDP(c, client.account, addrType, addrData, port)
 }
+
+func (client *Client) upgradeUDP(c net.Conn, acc *account, addrType byte, addrData []byte, port uint16) (*PacketConn, error) {
+	// 数据包的边界依赖chunk分帧来保持
+	if !client.hasOption(OptionS) && client.secType != SecTypeZero {
+		return nil, errors.New("udp requires chunk transport")
+	}
+
+	t := utils.NewAddrType(utils.ProtoVmess, addrType)
+	addr, err := utils.AddrString(t, addrData, port)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := client.upgrade(c, acc, CmdUDP, addrType, addrData, port)
+	return NewPacketConn(conn, utils.NewAddr("udp", addr)), nil
+}
+
+func (client *Client) upgrade(c net.Conn, acc *account, command byte, addrType byte, addrData []byte, port uint16) *ClientConn {
+	secType, option := client.secType, client.option
+	if secType == SecTypeZero {
+		// 与v2ray一致，实际发送的加密方式为none
+		// UDP仍然需要分块来保持数据包的边界
+		secType = SecTypeNone
+		if command == CmdUDP {
+			option = OptionS
+		}
+	}
+
+	cmd := NewCommandWithRand(
+		client.rand,
+		command,
+		option,
+		secType,
+		addrType, addrData, port,
+	)
+	cmd.SetLegacy(acc.isLegacy())
+
+	conn := &ClientConn{
+		Client:  client,
+		Conn:    c,
+		account: acc,
+		command: cmd,
+	}
+	// Mux与UDP的数据由客户端先发送，不需要提前发送指令
+	if command == CmdTCP {
+		conn.scheduleFlush(client.headerDelay)
+	}
+	return conn
+}
+
+func (client *Client) hasOption(op byte) bool { return (client.option & op) > 0 }
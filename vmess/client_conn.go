@@ -2,53 +2,128 @@ package vmess
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"crypto/cipher"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
 )
 
 type ClientConn struct {
 	*Client
 	net.Conn
 
+	account *account
 	command *Command
 
+	wmu        sync.Mutex
+	herr       atomic.Pointer[utils.HandshakeError] // 握手失败后，后续的读写都返回该错误
+	timer      atomic.Pointer[time.Timer]
 	dataWriter io.Writer
 	dataReader io.Reader
 }
 
 func (c *ClientConn) Write(buf []byte) (int, error) {
-	if c.dataWriter == nil {
-		//
-		// 使用AEAD发送认证信息和指令
-		// 这部分信息不受security和transport设置的影响
-		//
-		err := c.writeCommand()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	return c.dataWriter.Write(buf)
+}
+
+// 立即发送指令，用于服务端先发送数据的协议（如SSH、SMTP）
+// 默认情况下指令与第一次写入的数据一起发送
+func (c *ClientConn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.flush()
+}
+
+// 根据配置安排指令的发送时机
+// * delay为0：等待第一次写入
+// * delay小于0：立即发送
+// * delay大于0：超过delay仍没有写入时，单独发送指令
+func (c *ClientConn) scheduleFlush(delay time.Duration) {
+	switch {
+	case delay < 0:
+		c.Flush()
+	case delay > 0:
+		c.timer.Store(time.AfterFunc(delay, func() { c.Flush() }))
+	}
+}
+
+func (c *ClientConn) flush() error {
+	if herr := c.herr.Load(); herr != nil {
+		return herr
+	}
+	if c.dataWriter != nil {
+		return nil
+	}
+	if t := c.timer.Load(); t != nil {
+		t.Stop()
+	}
+
+	//
+	// 使用AEAD（alterId大于0时使用旧版认证）发送认证信息和指令
+	// 这部分信息不受security和transport设置的影响
+	//
+	err := c.writeCommand()
+	if err != nil {
+		log.Println("write vmess command to server failed: ", err)
+		return c.fail(utils.NewHandshakeError(utils.ErrTransport, err))
+	}
+
+	dataWriter := io.Writer(c.Conn)
+
+	// AES-128-CFB是对整个数据块进行加密，所以先
+	if c.command.GetSecType() == SecTypeAES128CFB {
+		key := c.command.GetRequestCipherKey()
+		iv := c.command.GetRequestCipherIV()
+		stream, err := NewAesCfbEncStream(key, iv)
 		if err != nil {
-			log.Println("write vmess command to server failed: ", err)
-			return 0, nil
+			return c.fail(utils.NewHandshakeError(utils.ErrTransport, err))
 		}
+		dataWriter = NewSecurityWriter(dataWriter, stream)
+	}
 
-		c.dataWriter = c.Conn
+	if c.command.HashOption(OptionS) {
+		dataWriter = NewChunkWriter(dataWriter, NewChunkWithCommand(c.command, true, true))
+	}
 
-		// AES-128-CFB是对整个数据块进行加密，所以先
-		if c.command.GetSecType() == SecTypeAES128CFB {
-			key := c.command.GetRequestCipherKey()
-			iv := c.command.GetRequestCipherIV()
-			stream, err := NewAesCfbEncStream(key, iv)
-			if err != nil {
-				return 0, err
-			}
-			c.dataWriter = NewSecurityWriter(c.dataWriter, stream)
-		}
+	c.dataWriter = dataWriter
+	return nil
+}
 
-		if c.command.HashOption(OptionS) {
-			c.dataWriter = NewChunkWriter(c.dataWriter, NewChunkWithCommand(c.command, true, true))
-		}
+// 记录第一次发生的握手错误
+func (c *ClientConn) fail(herr *utils.HandshakeError) error {
+	c.herr.CompareAndSwap(nil, herr)
+	return c.herr.Load()
+}
+
+// 结束发送方向，对端读取到io.EOF，另一方向仍然可以继续读取
+// * 分块传输时发送空的chunk
+// * 不分块时关闭底层连接的写方向（需要底层连接支持）
+func (c *ClientConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.flush(); err != nil {
+		return err
 	}
+	return closeWrite(c.dataWriter, c.Conn)
+}
 
-	return c.dataWriter.Write(buf)
+func (c *ClientConn) Close() error {
+	if t := c.timer.Load(); t != nil {
+		t.Stop()
+	}
+	return c.Conn.Close()
 }
 
 func (c *ClientConn) writeCommand() error {
@@ -57,32 +132,44 @@ func (c *ClientConn) writeCommand() error {
 	if err != nil {
 		return err
 	}
-	return SealAeadHeader(c.Conn, c.Client.cmdKey, header.Bytes())
+	if c.command.IsLegacy() {
+		timestamp := GenUTCTimeBytes(time.Now().Unix(), legacyTimeDelta)
+		return SealLegacyHeader(c.Conn, c.account.pickAlterID(c.Client.rand), c.account.cmdKey, timestamp, header.Bytes())
+	}
+	return SealAeadHeaderWithRand(c.Conn, c.Client.rand, c.account.cmdKey, header.Bytes())
 }
 
 func (c *ClientConn) Read(buf []byte) (int, error) {
+	if herr := c.herr.Load(); herr != nil {
+		return 0, herr
+	}
+
 	if c.dataReader == nil {
-		//
-		// VmessAEAD的应答包头是独立加密的
-		//
-		key := sha256.Sum256(c.command.GetRequestCipherKey())
-		iv := sha256.Sum256(c.command.GetRequestCipherIV())
-		headBuf, err := OpenAeadResponse(c.Conn, key[:16], iv[:16])
-		if err != nil {
-			log.Println("upgrade vmess reader failed: ", err)
-			return 0, err
+		key := c.command.GetResponseCipherKey()
+		iv := c.command.GetResponseCipherIV()
+		resp, stream, herr := c.readResponse(key, iv)
+		if herr != nil {
+			log.Println("upgrade vmess reader failed: ", herr)
+			return 0, c.fail(herr)
+		}
+
+		if resp.SwitchAccount != nil {
+			if err := c.Client.switchAccount(resp.SwitchAccount); err != nil {
+				log.Println("switch account failed: ", err)
+			}
 		}
-		headBufReader := bytes.NewBuffer(headBuf)
-		resp := NewResponse(c.command.GetResponseAuthV())
-		resp.ReadFrom(headBufReader)
 
 		c.dataReader = c.Conn
 
 		// AES-128-CFB 是对整个数据包进行加密，包含mask、padding，所以应该在分块读取之前
+		// 旧版认证时继续使用应答头部的解密流
 		if c.command.GetSecType() == SecTypeAES128CFB {
-			stream, err := NewAesCfbDecStream(key[:16], iv[:16])
-			if err != nil {
-				return 0, err
+			if stream == nil {
+				var err error
+				stream, err = NewAesCfbDecStream(key, iv)
+				if err != nil {
+					return 0, c.fail(utils.NewHandshakeError(utils.ErrTransport, err))
+				}
 			}
 			c.dataReader = NewSecurityReader(c.dataReader, stream)
 		}
@@ -94,3 +181,54 @@ func (c *ClientConn) Read(buf []byte) (int, error) {
 	}
 	return c.dataReader.Read(buf)
 }
+
+// 读取并校验应答头部，旧版认证时同时返回应答头部的解密流
+func (c *ClientConn) readResponse(key, iv []byte) (*Response, cipher.Stream, *utils.HandshakeError) {
+	resp := NewResponse(c.command.GetResponseAuthV())
+
+	// 记录底层连接的读取错误，用于区分读取失败与解密失败
+	raw := &readRecorder{r: c.Conn}
+
+	var r io.Reader
+	var stream cipher.Stream
+	if c.command.IsLegacy() {
+		// 旧版的应答头部与后续的数据使用同一个加密流
+		respReader, err := NewLegacyResponseReader(raw, key, iv)
+		if err != nil {
+			return nil, nil, utils.NewHandshakeError(utils.ErrTransport, err)
+		}
+		r, stream = respReader, respReader.S
+	} else {
+		// VmessAEAD的应答包头是独立加密的
+		headBuf, err := OpenAeadResponse(raw, key, iv)
+		if err != nil {
+			if raw.err != nil {
+				return nil, nil, utils.NewResponseReadError(err)
+			}
+			return nil, nil, utils.NewHandshakeError(utils.ErrResponseMismatch, err)
+		}
+		r = bytes.NewReader(headBuf)
+	}
+
+	_, err := resp.ReadFrom(r)
+	if err != nil {
+		if raw.err != nil {
+			return nil, nil, utils.NewResponseReadError(err)
+		}
+		return nil, nil, utils.NewHandshakeError(utils.ErrResponseMismatch, err)
+	}
+	return resp, stream, nil
+}
+
+type readRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *readRecorder) Read(buf []byte) (int, error) {
+	n, err := rr.r.Read(buf)
+	if err != nil {
+		rr.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,178 @@
+package vmess
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// 模拟服务端先发送数据的协议，如SMTP
+func runGreetingServer(t *testing.T, greeting string) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(greeting))
+			c.Close()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestClientConnHeaderDelay(t *testing.T) {
+	greeting := "220 service ready\r\n"
+	addr := runGreetingServer(t, greeting)
+
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	session, err := NewSession(id)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, delay := range []int{-1, 50} {
+		t.Run(fmt.Sprintf("delay=%v", delay), func(t *testing.T) {
+			client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+				"net": "tcp",
+				"add": "127.0.0.1",
+				"port": 20000,
+				"id": "%v",
+				"headerDelay": %v
+			}`, id, delay)))
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			c1, c2 := net.Pipe()
+			go session.Process(c2, nil)
+
+			conn := client.Upgrade(c1, utils.VmessAddrIPv4, addr.IP.To4(), uint16(addr.Port))
+			defer conn.Close()
+
+			// 没有写入任何数据，也能读取到服务端的数据
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			buf := make([]byte, len(greeting))
+			_, err = io.ReadFull(conn, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, greeting, string(buf))
+		})
+	}
+}
+
+func TestClientConnHandshakeError(t *testing.T) {
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v"
+	}`, id)))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// 服务端不认识该用户，直接关闭连接
+	session, _ := NewSession("27848739-7e62-4138-9fd3-098a63964b6b")
+	session.SetHandshakeTimeout(time.Millisecond * 100)
+	c1, c2 := net.Pipe()
+	go session.Process(c2, nil)
+	conn := client.Upgrade(c1, utils.VmessAddrDomain, []byte("localhost"), 80)
+	go conn.Write([]byte("hello"))
+	_, err = conn.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, utils.ErrAuthRejected)
+
+	// 之后连接不再可用
+	_, err2 := conn.Write([]byte("hello"))
+	assert.Equal(t, err, err2)
+	_, err2 = conn.Read(make([]byte, 10))
+	assert.Equal(t, err, err2)
+
+	// 应答无法解密
+	c1, c2 = net.Pipe()
+	go func() {
+		io.CopyN(io.Discard, c2, 1)
+		c2.Write(make([]byte, 64))
+	}()
+	conn = client.Upgrade(c1, utils.VmessAddrDomain, []byte("localhost"), 80)
+	go conn.Write([]byte("hello"))
+	_, err = conn.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, utils.ErrResponseMismatch)
+
+	// 底层连接已经关闭
+	c1, _ = net.Pipe()
+	c1.Close()
+	conn = client.Upgrade(c1, utils.VmessAddrDomain, []byte("localhost"), 80)
+	_, err = conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, utils.ErrTransport)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestClientConnCloseWrite(t *testing.T) {
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	session, _ := NewSession(id)
+
+	for _, transport := range []string{"chunk", "padding", "auth-length"} {
+		t.Run(transport, func(t *testing.T) {
+			client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+				"net": "tcp",
+				"add": "127.0.0.1",
+				"port": 20000,
+				"id": "%v",
+				"transport": "%v"
+			}`, id, transport)))
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			// 服务端：读取全部请求数据后应答，然后结束发送
+			go func() {
+				user, authBuf, err := session.Authentication(c2)
+				if !assert.Nil(t, err) {
+					return
+				}
+				cmd, err := session.ReadCommand(c2, user, authBuf)
+				if !assert.Nil(t, err) {
+					return
+				}
+				session.WriteResponse(c2, cmd)
+				server, _ := NewServerConn(c2, cmd)
+
+				request, err := io.ReadAll(server)
+				assert.Nil(t, err)
+				assert.Equal(t, "hello", string(request))
+
+				server.Write([]byte("world"))
+				assert.Nil(t, server.CloseWrite())
+			}()
+
+			conn := client.Upgrade(c1, utils.VmessAddrDomain, []byte("localhost"), 80).(*ClientConn)
+			// net.Pipe没有缓冲，写入需要与读取并发进行
+			go func() {
+				conn.Write([]byte("hello"))
+				assert.Nil(t, conn.CloseWrite())
+			}()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			response, err := io.ReadAll(conn)
+			assert.Nil(t, err)
+			assert.Equal(t, "world", string(response))
+		})
+	}
+}
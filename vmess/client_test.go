@@ -129,3 +129,25 @@ func runEchoServer(addr string, stop chan int) {
 		log.Println("test echo server stopped")
 	}()
 }
+
+func TestClientZeroSecurity(t *testing.T) {
+	client, err := NewClientFromBytes([]byte(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "b831381d-6324-4d53-ad4f-8cda48b30811",
+		"security": "zero"
+	}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// 发送的指令与v2ray保持一致：加密方式为none，且不分块
+	conn := client.upgrade(nil, client.account, CmdTCP, utils.VmessAddrDomain, []byte("localhost"), 80)
+	assert.Equal(t, SecTypeNone, conn.command.GetSecType())
+	assert.Equal(t, byte(0), conn.command.GetOption())
+
+	conn = client.upgrade(nil, client.account, CmdUDP, utils.VmessAddrDomain, []byte("localhost"), 53)
+	assert.Equal(t, SecTypeNone, conn.command.GetSecType())
+	assert.Equal(t, OptionS, conn.command.GetOption())
+}
@@ -1,12 +1,12 @@
 package vmess
 
 import (
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"io"
 	"log"
-	"math/rand"
 
 	"github.com/net-agent/protocol/utils"
 )
@@ -16,17 +16,23 @@ const (
 	OptionR = byte(0x02)
 	OptionM = byte(0x04)
 	OptionP = byte(0x08)
+	OptionA = byte(0x10) // 长度认证，仅支持AEAD加密方式
 
 	SecTypeAES128CFB        = byte(1)
 	SecTypeAES128GCM        = byte(3)
 	SecTypeChaCha20Poly1305 = byte(4)
 	SecTypeNone             = byte(5)
+	SecTypeZero             = byte(6) // 不分块也不加密，发送时使用none并清除OptionS与OptionM
 	SecTypeLegacy           = SecTypeAES128CFB
 
 	CmdTCP = byte(0x01)
 	CmdUDP = byte(0x02)
+	CmdMux = byte(0x03)
 )
 
+// Mux指令不携带Port与地址信息，头部只有38字节
+const muxHeaderSize = 38
+
 func NewCommandFromBuffer(buf []byte) (*Command, error) {
 	cmd := &Command{}
 	copy(cmd.CommandHeader[:], buf)
@@ -36,14 +42,19 @@ func NewCommandFromBuffer(buf []byte) (*Command, error) {
 	}
 
 	padStart := 0
-	switch cmd.GetAddressType() {
-	case utils.VmessAddrIPv4:
+	switch {
+	case cmd.GetCommand() == CmdMux:
+		// 头部之后紧跟着padding，拷贝过来的Port与地址类型字段无效
+		cmd.SetPort(0)
+		cmd.SetAddressType(0)
+		padStart = muxHeaderSize
+	case cmd.GetAddressType() == utils.VmessAddrIPv4:
 		cmd.addressData = buf[41:45]
 		padStart = 45
-	case utils.VmessAddrIPv6:
+	case cmd.GetAddressType() == utils.VmessAddrIPv6:
 		cmd.addressData = buf[41:57]
 		padStart = 57
-	case utils.VmessAddrDomain:
+	case cmd.GetAddressType() == utils.VmessAddrDomain:
 		domainSize := int(buf[41])
 		cmd.addressData = buf[42 : 42+domainSize]
 		padStart = 42 + domainSize
@@ -65,31 +76,49 @@ type Command struct {
 	addressData []byte
 	padding     []byte
 
+	rand              io.Reader // 生成padding使用的随机数来源，为nil时使用crypto/rand
+	legacy            bool      // 使用旧版认证，应答的key与iv使用MD5生成
 	responseCipherKey []byte
 	responseCipherIV  []byte
+	responseStream    cipher.Stream // 旧版认证时服务端应答头部的加密流，由Session.WriteResponse设置
 }
 
+func (cmd *Command) SetRand(r io.Reader)   { cmd.rand = r }
+func (cmd *Command) SetLegacy(legacy bool) { cmd.legacy = legacy }
+func (cmd *Command) IsLegacy() bool        { return cmd.legacy }
+
 func (cmd *Command) GetResponseCipherKey() []byte {
 	if cmd.responseCipherKey == nil {
-		buf := sha256.Sum256(cmd.GetRequestCipherKey())
-		cmd.responseCipherKey = buf[:16]
+		cmd.responseCipherKey = cmd.genResponseKey(cmd.GetRequestCipherKey())
 	}
 	return cmd.responseCipherKey
 }
 
 func (cmd *Command) GetResponseCipherIV() []byte {
 	if cmd.responseCipherIV == nil {
-		buf := sha256.Sum256(cmd.GetRequestCipherIV())
-		cmd.responseCipherIV = buf[:16]
+		cmd.responseCipherIV = cmd.genResponseKey(cmd.GetRequestCipherIV())
 	}
 	return cmd.responseCipherIV
 }
 
+func (cmd *Command) genResponseKey(buf []byte) []byte {
+	if cmd.legacy {
+		return GenBufsMd5(buf)
+	}
+	sum := sha256.Sum256(buf)
+	return sum[:16]
+}
+
 func NewCommand(command, option, secType byte, addressType byte, addressData []byte, port uint16) *Command {
-	cmd := &Command{}
+	return NewCommandWithRand(nil, command, option, secType, addressType, addressData, port)
+}
+
+// 使用指定的随机数来源生成请求的key与iv，r为nil时使用crypto/rand
+func NewCommandWithRand(r io.Reader, command, option, secType byte, addressType byte, addressData []byte, port uint16) *Command {
+	cmd := &Command{rand: r}
 
 	// 先生成命令的随机部分
-	randBuf := GenRandomBytes(16 + 16 + 1 + rand.Intn(16))
+	randBuf := genRandomBytes(r, 16+16+1+randIntn(r, 16))
 	requestIv := randBuf[0:16]
 	requestKey := randBuf[16:32]
 	responseAuthV := randBuf[32]
@@ -125,19 +154,24 @@ func (cmd *Command) SetPadding(padding []byte) {
 }
 
 func (cmd *Command) WriteTo(w io.Writer) (written int64, retErr error) {
+	header := cmd.CommandHeader[:]
+	addressData := cmd.addressData
 	var addressSize []byte
-	if cmd.GetAddressType() == utils.VmessAddrDomain {
+	if cmd.GetCommand() == CmdMux {
+		header = header[:muxHeaderSize]
+		addressData = nil
+	} else if cmd.GetAddressType() == utils.VmessAddrDomain {
 		addressSize = []byte{byte(len(cmd.addressData))}
 	}
 
 	checksum := GenBufsFnvSumBuf(nil,
-		cmd.CommandHeader[:],
+		header,
 		addressSize,
-		cmd.addressData,
+		addressData,
 		cmd.padding)
 
 	n := int(0)
-	bufs := [][]byte{cmd.CommandHeader[:], addressSize, cmd.addressData, cmd.padding, checksum}
+	bufs := [][]byte{header, addressSize, addressData, cmd.padding, checksum}
 	for index, buf := range bufs {
 		if buf == nil {
 			continue
@@ -3,6 +3,7 @@ package vmess
 import (
 	"bytes"
 	"fmt"
+	mrand "math/rand"
 	"testing"
 
 	"github.com/net-agent/protocol/utils"
@@ -14,6 +15,7 @@ func TestCommand(t *testing.T) {
 		NewCommand(1, 2, 3, utils.VmessAddrIPv4, []byte{1, 2, 3, 4}, 1234),
 		NewCommand(1, 2, 3, utils.VmessAddrIPv6, []byte{1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4}, 5678),
 		NewCommand(1, 2, 3, utils.VmessAddrDomain, []byte("hello.world.com"), 9876),
+		NewCommand(CmdMux, 2, 3, 0, nil, 0),
 	}
 
 	for i, cmd := range cmds {
@@ -32,3 +34,25 @@ func TestCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestNewCommandWithRand(t *testing.T) {
+	gen := func(seed int64) []byte {
+		r := mrand.New(mrand.NewSource(seed))
+		cmd := NewCommandWithRand(r, CmdTCP, OptionS|OptionM|OptionP, SecTypeAES128GCM, utils.VmessAddrDomain, []byte("localhost"), 80)
+		buf := bytes.NewBuffer(nil)
+		cmd.WriteTo(buf)
+
+		// 数据块的padding也使用同一个随机数来源
+		chunk := bytes.NewBuffer(nil)
+		NewChunkWithCommand(cmd, true, true).SetData([]byte("hello")).WriteTo(chunk)
+		return append(buf.Bytes(), chunk.Bytes()...)
+	}
+
+	assert.Equal(t, gen(1), gen(1))
+	assert.NotEqual(t, gen(1), gen(2))
+
+	// 默认使用crypto/rand
+	cmd1 := NewCommand(CmdTCP, 0, SecTypeNone, utils.VmessAddrDomain, []byte("localhost"), 80)
+	cmd2 := NewCommand(CmdTCP, 0, SecTypeNone, utils.VmessAddrDomain, []byte("localhost"), 80)
+	assert.NotEqual(t, cmd1.GetRequestCipherKey(), cmd2.GetRequestCipherKey())
+}
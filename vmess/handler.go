@@ -0,0 +1,137 @@
+package vmess
+
+import (
+	"log"
+	"net"
+
+	"github.com/net-agent/protocol/mux"
+	"github.com/net-agent/protocol/utils"
+)
+
+// 通过vmess认证后解析出的请求
+type Request struct {
+	User     *User
+	Command  byte   // CmdTCP/CmdUDP，Mux子连接按其网络类型给出
+	Security byte   // 客户端指定的加密方式
+	Option   byte   // 客户端指定的传输选项
+	Addr     string // 目标地址
+	Mux      bool   // 是否为Mux会话中的子连接
+
+	AddrType byte // VmessAddrXXX
+	AddrData []byte
+	Port     uint16
+}
+
+func newRequest(user *User, cmd *Command) (*Request, error) {
+	req := &Request{
+		User:     user,
+		Command:  cmd.GetCommand(),
+		Security: cmd.GetSecType(),
+		Option:   cmd.GetOption(),
+		AddrType: cmd.GetAddressType(),
+		AddrData: cmd.addressData,
+		Port:     cmd.GetPort(),
+	}
+	if req.Command != CmdMux {
+		t := utils.NewAddrType(utils.ProtoVmess, req.AddrType)
+		addr, err := utils.AddrString(t, req.AddrData, req.Port)
+		if err != nil {
+			return nil, err
+		}
+		req.Addr = addr
+	}
+	return req, nil
+}
+
+// Mux子连接继承所属会话的用户与加密方式，目标地址来自子连接
+func newStreamRequest(parent *Request, st *mux.Stream) (*Request, error) {
+	t, addrData, port := st.Target()
+	addr, err := st.TargetString()
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{
+		User:     parent.User,
+		Command:  CmdTCP,
+		Security: parent.Security,
+		Option:   parent.Option,
+		Addr:     addr,
+		Mux:      true,
+		AddrType: t.Byte(utils.ProtoVmess),
+		AddrData: addrData,
+		Port:     port,
+	}
+	if st.Network() == mux.NetworkUDP {
+		req.Command = CmdUDP
+	}
+	return req, nil
+}
+
+// vmess请求的处理接口，Handle返回后连接会被关闭
+// 应答头部在第一次写入数据或者调用conn.Accept时发送，
+// 在此之前返回错误，客户端读取应答时得到utils.ErrAuthRejected。
+// Mux会话由Session展开，每条子连接单独调用一次Handle，此时conn.Accept不会发送数据
+type Handler interface {
+	Handle(conn *ServerConn, req *Request) error
+}
+
+type HandlerFunc func(conn *ServerConn, req *Request) error
+
+func (f HandlerFunc) Handle(conn *ServerConn, req *Request) error { return f(conn, req) }
+
+// 交由handler处理，未设置时使用DialAndLink
+func (s *Session) handle(conn *ServerConn, req *Request) error {
+	if req.Command == CmdMux {
+		return s.serveMux(conn, req)
+	}
+	if s.handler != nil {
+		return s.handler.Handle(conn, req)
+	}
+	return s.DialAndLink(conn, req)
+}
+
+// 发送应答后在连接上处理Mux.Cool帧
+func (s *Session) serveMux(conn *ServerConn, req *Request) error {
+	if err := conn.Accept(); err != nil {
+		return err
+	}
+	return mux.Serve(conn, func(st *mux.Stream) error {
+		sub, err := newStreamRequest(req, st)
+		if err != nil {
+			return err
+		}
+		log.Printf("mux accepted. user='%v' target='%v'\n", sub.User, sub.Addr)
+		return s.handle(newStreamConn(st, sub.User), sub)
+	})
+}
+
+// 默认的请求处理：连接目标地址并双向转发
+func (s *Session) DialAndLink(conn *ServerConn, req *Request) error {
+	if req.Command == CmdMux {
+		return s.serveMux(conn, req)
+	}
+
+	var target net.Conn
+	var err error
+	if req.Command == CmdUDP {
+		target, err = utils.DialUDP(req.Addr)
+	} else {
+		target, err = utils.Dial(req.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if err := conn.Accept(); err != nil {
+		return err
+	}
+
+	if req.Command == CmdUDP {
+		utils.LinkPacketAndLog(req.Addr, target, NewPacketConn(conn, target.RemoteAddr()), utils.DefaultPacketIdleTimeout)
+		return nil
+	}
+
+	utils.LinkAndLog(req.Addr, target, conn, s.idle)
+	return nil
+}
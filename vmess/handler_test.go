@@ -0,0 +1,128 @@
+package vmess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionHandler(t *testing.T) {
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v"
+	}`, id)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	session, _ := NewSession(id)
+
+	reqs := make(chan *Request, 1)
+	session.SetHandler(HandlerFunc(func(conn *ServerConn, req *Request) error {
+		reqs <- req
+		if req.Addr != "echo.local:80" {
+			return errors.New("rejected")
+		}
+		_, err := io.Copy(conn, conn)
+		return err
+	}))
+
+	// 由handler代替连接目标地址
+	c1, c2 := net.Pipe()
+	go session.Process(c2, nil)
+	conn := client.Upgrade(c1, utils.VmessAddrDomain, []byte("echo.local"), 80)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	req := <-reqs
+	assert.Equal(t, CmdTCP, req.Command)
+	assert.Equal(t, SecTypeAES128GCM, req.Security)
+	assert.Equal(t, session.Users()[0], req.User)
+
+	// handler在发送应答前返回错误，客户端视为拒绝
+	c1, c2 = net.Pipe()
+	go session.Process(c2, nil)
+	conn = client.Upgrade(c1, utils.VmessAddrDomain, []byte("other.local"), 80)
+	go conn.Write([]byte("hello"))
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, utils.ErrAuthRejected)
+	assert.Equal(t, "other.local:80", (<-reqs).Addr)
+}
+
+// Mux会话中的每条子连接单独交由handler处理
+func TestSessionMuxHandler(t *testing.T) {
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v",
+		"mux": 1
+	}`, id)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	session, _ := NewSession(id)
+	client.dial = func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go session.Process(c2, nil)
+		return c1, nil
+	}
+
+	reqs := make(chan *Request, 2)
+	session.SetHandler(HandlerFunc(func(conn *ServerConn, req *Request) error {
+		reqs <- req
+		if req.Addr != "echo.local:80" {
+			return errors.New("rejected")
+		}
+		_, err := io.Copy(conn, conn)
+		return err
+	}))
+
+	conn, err := client.Dial("tcp", utils.VmessAddrDomain, []byte("echo.local"), 80)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	req := <-reqs
+	assert.True(t, req.Mux)
+	assert.Equal(t, CmdTCP, req.Command)
+	assert.Equal(t, utils.VmessAddrDomain, req.AddrType)
+	assert.Equal(t, session.Users()[0], req.User)
+
+	// handler返回后子连接被关闭，不影响同一会话中的其它子连接
+	other, err := client.Dial("tcp", utils.VmessAddrDomain, []byte("other.local"), 80)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err = other.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "other.local:80", (<-reqs).Addr)
+
+	go conn.Write([]byte("world"))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf))
+}
@@ -0,0 +1,315 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+// 旧版VMess（alterId > 0）的认证与指令加密
+// * 认证信息：HMAC-MD5(uuid, timestamp)，uuid从alterId派生的id中随机选取
+// * 指令部分：AES-128-CFB，key为cmdKey，iv为MD5(timestamp * 4)
+// * 应答头部：AES-128-CFB，key与iv为请求key与iv的MD5值，security为aes-128-cfb时数据部分继续使用该加密流
+
+// 客户端生成时间戳时允许的随机误差（秒）
+const legacyTimeDelta = 30
+
+// 根据主id派生alterId个id，与v2ray的派生方式保持一致
+func NewAlterIDs(primary []byte, alterId int) [][]byte {
+	ids := make([][]byte, alterId)
+	prev := primary
+	for i := range ids {
+		ids[i] = nextAlterID(prev)
+		prev = ids[i]
+	}
+	return ids
+}
+
+func nextAlterID(prev []byte) []byte {
+	h := md5.New()
+	h.Write(prev)
+	h.Write([]byte("16167dc8-16b6-4e6d-b8bb-65dd68113a81"))
+	for {
+		id := h.Sum(nil)
+		if !bytes.Equal(id, prev) {
+			return id
+		}
+		h.Write([]byte("533eff8a-4113-4b10-b5ce-0f5d76b98cd2"))
+	}
+}
+
+// 指令部分的加密iv
+func genLegacyHeaderIV(timestamp []byte) []byte {
+	return GenBufsMd5(timestamp, timestamp, timestamp, timestamp)
+}
+
+// 发送[认证信息 16B][加密的指令]，tsBuf为8字节的时间戳
+func SealLegacyHeader(w io.Writer, authID []byte, cmdKey [16]byte, tsBuf []byte, plainHeader []byte) error {
+	stream, err := NewAesCfbEncStream(cmdKey[:], genLegacyHeaderIV(tsBuf))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16+len(plainHeader))
+	copy(buf, GenAuthData(authID, tsBuf))
+	stream.XORKeyStream(buf[16:], plainHeader)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// 读取并解密指令部分，认证信息已经在外部读取
+func OpenLegacyHeader(r io.Reader, cmdKey [16]byte, timestamp int64) ([]byte, error) {
+	stream, err := NewAesCfbDecStream(cmdKey[:], genLegacyHeaderIV(GenUTCTimeBytes(timestamp, 0)))
+	if err != nil {
+		return nil, err
+	}
+	r = cipher.StreamReader{S: stream, R: r}
+
+	// 指令长度不固定，需要根据已读取的内容确定剩余部分的长度
+	// 最短的Mux指令也有38+4字节，所以可以先读取固定的头部
+	buf := make([]byte, len(CommandHeader{}), 64+0x0f+4)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	h := (*CommandHeader)(buf)
+
+	size := 0
+	switch {
+	case h.GetCommand() == CmdMux:
+		size = muxHeaderSize
+	case h.GetAddressType() == utils.VmessAddrIPv4:
+		size = 45
+	case h.GetAddressType() == utils.VmessAddrIPv6:
+		size = 57
+	case h.GetAddressType() == utils.VmessAddrDomain:
+		buf = buf[:42]
+		if _, err = io.ReadFull(r, buf[41:]); err != nil {
+			return nil, err
+		}
+		size = 42 + int(buf[41])
+	default:
+		return nil, errors.New("invalid address type")
+	}
+	size += int(h.GetPaddingSize()) + 4
+
+	if size > len(buf) {
+		readed := len(buf)
+		buf = append(buf, make([]byte, size-readed)...)
+		if _, err = io.ReadFull(r, buf[readed:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// 旧版的应答头部只使用AES-128-CFB加密，没有长度字段
+// 返回加密流，security为aes-128-cfb时数据部分需要继续使用
+func SealLegacyResponse(w io.Writer, key, iv []byte, plainData []byte) (cipher.Stream, error) {
+	stream, err := NewAesCfbEncStream(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(plainData))
+	stream.XORKeyStream(buf, plainData)
+	if _, err = w.Write(buf); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 读取应答头部后，StreamReader.S可以继续用于解密数据部分
+func NewLegacyResponseReader(r io.Reader, key, iv []byte) (cipher.StreamReader, error) {
+	stream, err := NewAesCfbDecStream(key, iv)
+	if err != nil {
+		return cipher.StreamReader{}, err
+	}
+	return cipher.StreamReader{S: stream, R: r}, nil
+}
+
+// 服务端使用的认证信息表
+// 预先计算时间窗口内每个时间戳对应的认证信息，查找时直接命中
+// 每秒只需要生成新的一秒的记录并移除过期的一秒，由查找时发现过期的goroutine在后台完成，
+// 未命中时同步完成
+type legacyAuthTable struct {
+	updateMu sync.Mutex // 保证同一时间只有一个更新，生成记录时不持有mu
+
+	mu      sync.RWMutex
+	users   []*User
+	entries map[[16]byte]legacyEntry
+	keys    map[int64][][16]byte // 每个时间戳生成的记录，用于移除过期记录
+	begin   int64                // 已经生成的时间范围：[begin, end]
+	end     int64
+}
+
+type legacyEntry struct {
+	user      *User
+	timestamp int64
+}
+
+func newLegacyAuthTable() *legacyAuthTable {
+	return &legacyAuthTable{
+		entries: make(map[[16]byte]legacyEntry),
+		keys:    make(map[int64][][16]byte),
+	}
+}
+
+func (t *legacyAuthTable) add(u *User) {
+	t.updateMu.Lock()
+	defer t.updateMu.Unlock()
+
+	t.mu.Lock()
+	t.users = append(t.users, u)
+	begin, end := t.begin, t.end
+	t.mu.Unlock()
+
+	if end == 0 {
+		t.update(time.Now().Unix())
+		return
+	}
+	entries := make(map[int64][]legacyKey)
+	for ts := begin; ts <= end; ts++ {
+		entries[ts] = genLegacyKeys([]*User{u}, ts)
+	}
+	t.mu.Lock()
+	t.insert(entries)
+	t.mu.Unlock()
+}
+
+func (t *legacyAuthTable) remove(u *User) {
+	t.updateMu.Lock()
+	defer t.updateMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, exist := range t.users {
+		if exist == u {
+			t.users = append(t.users[:i:i], t.users[i+1:]...)
+			break
+		}
+	}
+	for key, entry := range t.entries {
+		if entry.user == u {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// 查找认证信息对应的用户以及客户端使用的时间戳
+func (t *legacyAuthTable) lookup(authInfo []byte, now int64) (*User, int64, bool) {
+	var key [16]byte
+	copy(key[:], authInfo)
+
+	entry, found, stale := t.get(key, now)
+	if stale {
+		if found {
+			// 已经命中，在后台更新即可
+			if t.updateMu.TryLock() {
+				go func() {
+					defer t.updateMu.Unlock()
+					t.update(now)
+				}()
+			}
+		} else {
+			// 记录表落后时（例如空闲了一段时间）未命中的记录可能还没有生成，同步更新后重新查找
+			t.updateMu.Lock()
+			t.update(now)
+			t.updateMu.Unlock()
+			entry, found, _ = t.get(key, now)
+		}
+	}
+	if !found {
+		return nil, 0, false
+	}
+	return entry.user, entry.timestamp, true
+}
+
+// 只返回时间戳在now的时间窗口内的记录，同时判断记录表是否需要更新
+func (t *legacyAuthTable) get(key [16]byte, now int64) (legacyEntry, bool, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entry, found := t.entries[key]
+	// 记录表可能还没有更新，以传入的时间为准
+	found = found && entry.timestamp >= now-AuthTimeWindow && entry.timestamp <= now+AuthTimeWindow
+	// 时间前进，或者后退了很多（例如校准了时钟）时更新，并发的查找跨过整秒时不会来回更新
+	stale := t.end != 0 && (now+AuthTimeWindow > t.end || now+AuthTimeWindow < t.end-AuthTimeWindow)
+	return entry, found, stale
+}
+
+type legacyKey struct {
+	key   [16]byte
+	entry legacyEntry
+}
+
+// 将记录表更新到[now-AuthTimeWindow, now+AuthTimeWindow]，调用时需要持有updateMu
+// 只生成缺少的时间戳，生成记录时不持有mu，不影响查找
+func (t *legacyAuthTable) update(now int64) {
+	begin, end := now-AuthTimeWindow, now+AuthTimeWindow
+
+	t.mu.RLock()
+	users := t.users
+	oldBegin, oldEnd := t.begin, t.end
+	t.mu.RUnlock()
+
+	// 首次生成，或者时间跳变过大，已有的记录都不可用
+	reset := oldEnd == 0 || begin > oldEnd || end < oldBegin
+	entries := make(map[int64][]legacyKey)
+	for ts := begin; ts <= end; ts++ {
+		if reset || ts < oldBegin || ts > oldEnd {
+			entries[ts] = genLegacyKeys(users, ts)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if reset {
+		t.entries = make(map[[16]byte]legacyEntry)
+		t.keys = make(map[int64][][16]byte)
+	} else {
+		// 移除过期的记录
+		for ts, keys := range t.keys {
+			if ts < begin || ts > end {
+				for _, key := range keys {
+					delete(t.entries, key)
+				}
+				delete(t.keys, ts)
+			}
+		}
+	}
+	t.insert(entries)
+	t.begin, t.end = begin, end
+}
+
+// 调用时需要持有mu
+func (t *legacyAuthTable) insert(entries map[int64][]legacyKey) {
+	for ts, keys := range entries {
+		for _, k := range keys {
+			t.entries[k.key] = k.entry
+			t.keys[ts] = append(t.keys[ts], k.key)
+		}
+	}
+}
+
+func genLegacyKeys(users []*User, timestamp int64) []legacyKey {
+	tsBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(tsBuf, uint64(timestamp))
+
+	var keys []legacyKey
+	for _, u := range users {
+		entry := legacyEntry{user: u, timestamp: timestamp}
+		for _, id := range append([][]byte{u.ID}, u.alterIds...) {
+			k := legacyKey{entry: entry}
+			copy(k.key[:], GenAuthData(id, tsBuf))
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,192 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAlterIDs(t *testing.T) {
+	userid, _ := utils.ParseUUID("b831381d-6324-4d53-ad4f-8cda48b30811")
+	ids := NewAlterIDs(userid, 4)
+	assert.Equal(t, 4, len(ids))
+	assert.Equal(t, ids, NewAlterIDs(userid, 4))
+	assert.Equal(t, ids[:2], NewAlterIDs(userid, 2))
+	for _, id := range ids {
+		assert.Equal(t, 16, len(id))
+		assert.False(t, bytes.Equal(userid, id))
+	}
+}
+
+func TestLegacyAuthTable(t *testing.T) {
+	u, err := NewLegacyUser("b831381d-6324-4d53-ad4f-8cda48b30811", "", 2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	table := newLegacyAuthTable()
+	table.add(u)
+
+	now := time.Now().Unix()
+	tsBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(tsBuf, uint64(now-10))
+	authInfo := GenAuthData(u.alterIds[1], tsBuf)
+
+	found, timestamp, ok := table.lookup(authInfo, now)
+	assert.True(t, ok)
+	assert.Equal(t, u, found)
+	assert.Equal(t, now-10, timestamp)
+
+	// 时间前进后，新的一秒的记录在后台生成
+	binary.BigEndian.PutUint64(tsBuf, uint64(now+AuthTimeWindow+1))
+	future := GenAuthData(u.ID, tsBuf)
+	assert.Eventually(t, func() bool {
+		_, _, ok := table.lookup(future, now+1)
+		return ok
+	}, time.Second, time.Millisecond*10)
+
+	// 超出时间窗口后记录被移除
+	_, _, ok = table.lookup(authInfo, now+AuthTimeWindow)
+	assert.False(t, ok)
+
+	// 空闲了一段时间后，第一次查找就能命中
+	later := now + AuthTimeWindow*3
+	binary.BigEndian.PutUint64(tsBuf, uint64(later))
+	found, timestamp, ok = table.lookup(GenAuthData(u.ID, tsBuf), later)
+	assert.True(t, ok)
+	assert.Equal(t, u, found)
+	assert.Equal(t, later, timestamp)
+
+	table.remove(u)
+	_, _, ok = table.lookup(authInfo, now)
+	assert.False(t, ok)
+}
+
+func TestSessionLegacy(t *testing.T) {
+	echoAddr := runTCPEchoServer(t)
+
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	user, err := NewLegacyUser(id, "", 4)
+	if !assert.Nil(t, err) {
+		return
+	}
+	session, err := NewSessionWithUsers(user)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	tests := []struct {
+		security  string
+		transport string
+	}{
+		{"none", "stream"},
+		{"aes-128-cfb", "chunk"},
+		{"aes-128-gcm", "padding"},
+		{"chacha20-poly1305", "mask"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.security+"/"+tt.transport, func(t *testing.T) {
+			client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+				"net": "tcp",
+				"add": "127.0.0.1",
+				"port": 20000,
+				"id": "%v",
+				"aid": 4,
+				"security": "%v",
+				"transport": "%v"
+			}`, id, tt.security, tt.transport)))
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			c1, c2 := net.Pipe()
+			go session.Process(c2, nil)
+			conn := client.Upgrade(c1, utils.VmessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+			payload := make([]byte, 20*1024)
+			rand.Read(payload)
+			go conn.Write(payload)
+
+			buf := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, buf)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payload, buf))
+		})
+	}
+
+	// alterId为0的用户不接受旧版认证
+	session, _ = NewSession(id)
+	session.SetHandshakeTimeout(time.Millisecond * 100)
+	client, _ := NewClientFromBytes([]byte(fmt.Sprintf(`{"net":"tcp","add":"127.0.0.1","port":20000,"id":"%v","aid":4}`, id)))
+	c1, c2 := net.Pipe()
+	errch := make(chan error, 1)
+	go func() { errch <- session.Process(c2, nil) }()
+	conn := client.Upgrade(c1, utils.VmessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+	go conn.Write([]byte("hello"))
+	assert.Equal(t, ErrUserNotFound, <-errch)
+	conn.Close()
+}
+
+// 旧版认证使用aes-128-cfb时，应答头部与数据部分是同一个加密流
+func TestLegacyResponseStream(t *testing.T) {
+	session, _ := NewSession("b831381d-6324-4d53-ad4f-8cda48b30811")
+	cmd := NewCommand(CmdTCP, 0, SecTypeAES128CFB, utils.VmessAddrIPv4, []byte{127, 0, 0, 1}, 80)
+	cmd.SetLegacy(true)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		server, err := NewServerConn(c2, cmd)
+		if !assert.Nil(t, err) {
+			return
+		}
+		server.respond = func() error { return session.WriteResponse(c2, cmd) }
+		server.Write([]byte("hello"))
+	}()
+
+	buf := make([]byte, 4+5)
+	c1.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(c1, buf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	stream, _ := NewAesCfbDecStream(cmd.GetResponseCipherKey(), cmd.GetResponseCipherIV())
+	stream.XORKeyStream(buf, buf)
+	assert.Equal(t, cmd.GetResponseAuthV(), buf[0])
+	assert.Equal(t, "hello", string(buf[4:]))
+}
+
+// 重放旧版认证的请求
+func TestSessionLegacyReplay(t *testing.T) {
+	user, _ := NewLegacyUser("b831381d-6324-4d53-ad4f-8cda48b30811", "", 2)
+	session, _ := NewSessionWithUsers(user)
+	session.SetHandshakeTimeout(0)
+	session.SetHandler(HandlerFunc(func(conn *ServerConn, req *Request) error { return nil }))
+
+	header := bytes.NewBuffer(nil)
+	NewCommand(CmdTCP, OptionS, SecTypeNone, utils.VmessAddrIPv4, []byte{127, 0, 0, 1}, 80).WriteTo(header)
+	request := bytes.NewBuffer(nil)
+	err := SealLegacyHeader(request, user.alterIds[0], user.cmdKey, GenUTCTimeBytes(time.Now().Unix(), 0), header.Bytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	process := func() error {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go c1.Write(request.Bytes())
+		return session.Process(c2, nil)
+	}
+	assert.Nil(t, process())
+	assert.Equal(t, ErrReplayedAuthID, process())
+}
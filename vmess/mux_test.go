@@ -0,0 +1,98 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func runTCPEchoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestSessionMux(t *testing.T) {
+	echoAddr := runTCPEchoServer(t)
+
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v",
+		"security": "aes-128-gcm",
+		"transport": "padding",
+		"mux": 2
+	}`, id)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	session, err := NewSession(id)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var dialed int
+	client.dial = func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		dialed++
+		go session.Process(c2, nil)
+		return c1, nil
+	}
+
+	conns := []net.Conn{}
+	for i := 0; i < 4; i++ {
+		c, err := client.Dial("tcp", utils.VmessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+		if !assert.Nil(t, err) {
+			return
+		}
+		conns = append(conns, c)
+	}
+	assert.Equal(t, 2, dialed)
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			defer c.Close()
+
+			payload := make([]byte, 32*1024)
+			rand.Read(payload)
+			go c.Write(payload)
+
+			buf := make([]byte, len(payload))
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			_, err := io.ReadFull(c, buf)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payload, buf))
+		}(c)
+	}
+	wg.Wait()
+}
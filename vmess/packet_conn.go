@@ -0,0 +1,55 @@
+package vmess
+
+import (
+	"errors"
+	"net"
+
+	"github.com/net-agent/protocol/utils"
+)
+
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// 基于chunk分帧的数据包连接，每个chunk承载一个完整的UDP数据包
+// VMess的UDP会话在指令中绑定了目标地址，所以WriteTo会忽略addr参数
+type PacketConn struct {
+	net.Conn
+	raddr net.Addr
+	cache []byte
+}
+
+func NewPacketConn(c net.Conn, raddr net.Addr) *PacketConn {
+	return &PacketConn{
+		Conn:  c,
+		raddr: raddr,
+		cache: make([]byte, utils.MaxPacketSize),
+	}
+}
+
+// 读取一个完整的数据包，buf长度不足时超出部分会被丢弃
+func (pc *PacketConn) Read(buf []byte) (int, error) {
+	n, err := pc.Conn.Read(pc.cache)
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, pc.cache[:n]), nil
+}
+
+// 将buf作为一个独立的数据包写出
+func (pc *PacketConn) Write(buf []byte) (int, error) {
+	if len(buf) > MaxDataSize {
+		return 0, ErrPacketTooLarge
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	return pc.Conn.Write(buf)
+}
+
+func (pc *PacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, err := pc.Read(buf)
+	return n, pc.raddr, err
+}
+
+func (pc *PacketConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	return pc.Write(buf)
+}
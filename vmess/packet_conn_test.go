@@ -0,0 +1,129 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func runUDPEchoServer(t *testing.T) *net.UDPAddr {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		buf := make([]byte, utils.MaxPacketSize)
+		for {
+			n, addr, err := l.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			l.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return l.LocalAddr().(*net.UDPAddr)
+}
+
+func TestSessionUDP(t *testing.T) {
+	echoAddr := runUDPEchoServer(t)
+
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	tmp := `{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v",
+		"security": "%v",
+		"transport": "%v"
+	}`
+
+	tests := []struct {
+		security string
+		trasport string
+	}{
+		{"none", "chunk"},
+		{"none", "mask"},
+		{"aes-128-cfb", "chunk"},
+		{"aes-128-cfb", "mask"},
+		{"aes-128-gcm", "chunk"},
+		{"aes-128-gcm", "padding"},
+		{"chacha20-poly1305", "chunk"},
+		{"chacha20-poly1305", "padding"},
+		{"zero", "stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("test sec='%v' trans='%v'", tt.security, tt.trasport), func(t *testing.T) {
+			client, err := NewClientFromBytes([]byte(fmt.Sprintf(tmp, id, tt.security, tt.trasport)))
+			if !assert.Nil(t, err) {
+				return
+			}
+			session, err := NewSession(id)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			c1, c2 := net.Pipe()
+			go session.Process(c2, nil)
+
+			pc, err := client.UpgradeUDP(c1, utils.VmessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer pc.Close()
+			pc.SetDeadline(time.Now().Add(time.Second * 5))
+
+			// 每个包都应该被完整地送达，并保持边界
+			for _, size := range []int{1, 100, 1400, MaxDataSize} {
+				payload := make([]byte, size)
+				rand.Read(payload)
+
+				// net.Pipe没有缓冲，写入需要与读取并发进行
+				go func() {
+					_, err := pc.Write(payload)
+					assert.Nil(t, err)
+				}()
+
+				buf := make([]byte, utils.MaxPacketSize)
+				n, addr, err := pc.ReadFrom(buf)
+				if !assert.Nil(t, err) {
+					return
+				}
+				assert.True(t, bytes.Equal(payload, buf[:n]))
+				assert.Equal(t, echoAddr.String(), addr.String())
+			}
+
+			_, err = pc.Write(make([]byte, MaxDataSize+1))
+			assert.Equal(t, ErrPacketTooLarge, err)
+		})
+	}
+}
+
+func TestUpgradeUDPWithStream(t *testing.T) {
+	client, err := NewClientFromBytes([]byte(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "b831381d-6324-4d53-ad4f-8cda48b30811",
+		"security": "none",
+		"transport": "stream"
+	}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, err = client.UpgradeUDP(c1, utils.VmessAddrIPv4, []byte{127, 0, 0, 1}, 53)
+	assert.NotNil(t, err)
+}
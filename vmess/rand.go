@@ -0,0 +1,41 @@
+package vmess
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// 所有与安全相关的随机数都来自crypto/rand
+// Client与Session可以通过SetRand替换随机数来源，便于测试时复现结果
+
+func randReader(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
+// 随机数来源不可用时无法安全地继续，直接panic
+func readRandom(r io.Reader, buf []byte) {
+	if _, err := io.ReadFull(randReader(r), buf); err != nil {
+		panic("read random failed: " + err.Error())
+	}
+}
+
+// 生成[0, n)范围内的随机数，n较小时取模的偏差可以忽略
+func randIntn(r io.Reader, n int) int {
+	var buf [4]byte
+	readRandom(r, buf[:])
+	return int(binary.BigEndian.Uint32(buf[:]) % uint32(n))
+}
+
+func genRandomBytes(r io.Reader, size int) []byte {
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	readRandom(r, buf)
+	return buf
+}
@@ -0,0 +1,71 @@
+package vmess
+
+import (
+	"sync"
+	"time"
+)
+
+// 防重放过滤器，记录一段时间内出现过的认证信息
+//
+// 记录按时间分为两个桶轮换：每经过interval，丢弃旧桶并用新桶接收新记录，
+// 所以每条记录至少保留interval时长。新桶已满时提前轮换，内存占用不超过两个桶的capacity，
+// 此时最早的记录会提前被丢弃，但不会因为大量握手而拒绝正常的连接
+type ReplayFilter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	capacity int
+	swapAt   time.Time
+	current  map[[16]byte]struct{}
+	previous map[[16]byte]struct{}
+}
+
+// 每个桶最多记录的条数
+const DefaultReplayCapacity = 1 << 20
+
+func NewReplayFilter(interval time.Duration, capacity int) *ReplayFilter {
+	return &ReplayFilter{
+		interval: interval,
+		capacity: capacity,
+		swapAt:   time.Now(),
+		current:  make(map[[16]byte]struct{}),
+		previous: make(map[[16]byte]struct{}),
+	}
+}
+
+// 检查并记录认证信息，如果已经出现过则返回false
+func (f *ReplayFilter) Check(authid []byte) bool {
+	return f.check(authid, time.Now())
+}
+
+func (f *ReplayFilter) check(authid []byte, now time.Time) bool {
+	var key [16]byte
+	copy(key[:], authid)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if elapsed := now.Sub(f.swapAt); elapsed >= f.interval {
+		f.previous = f.current
+		// 长时间没有轮换时，两个桶的记录都已经过期
+		if elapsed >= 2*f.interval {
+			f.previous = make(map[[16]byte]struct{})
+		}
+		f.current = make(map[[16]byte]struct{})
+		f.swapAt = now
+	}
+
+	if _, found := f.current[key]; found {
+		return false
+	}
+	if _, found := f.previous[key]; found {
+		return false
+	}
+	if len(f.current) >= f.capacity {
+		f.previous = f.current
+		f.current = make(map[[16]byte]struct{})
+		f.swapAt = now
+	}
+
+	f.current[key] = struct{}{}
+	return true
+}
@@ -0,0 +1,78 @@
+package vmess
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter(time.Minute, 2)
+	now := time.Now()
+	id1 := bytes.Repeat([]byte{1}, 16)
+	id2 := bytes.Repeat([]byte{2}, 16)
+	id3 := bytes.Repeat([]byte{3}, 16)
+
+	assert.True(t, f.check(id1, now))
+	assert.False(t, f.check(id1, now))
+	assert.True(t, f.check(id2, now))
+
+	// 桶已满时提前轮换，旧记录仍然有效
+	assert.True(t, f.check(id3, now))
+	assert.False(t, f.check(id1, now))
+	assert.False(t, f.check(id3, now))
+
+	// 再次轮换，id1所在的桶被丢弃
+	now = now.Add(time.Minute)
+	assert.True(t, f.check(id1, now))
+	assert.False(t, f.check(id3, now))
+
+	// 长时间没有轮换，所有记录都已过期
+	now = now.Add(time.Minute * 5)
+	assert.True(t, f.check(id3, now))
+}
+
+// 记录所有写入的数据
+type recordConn struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (c *recordConn) Write(buf []byte) (int, error) { return c.Buffer.Write(buf) }
+func (c *recordConn) Read(buf []byte) (int, error)  { return c.Buffer.Read(buf) }
+
+// 捕获客户端发出的完整请求，重放给服务端
+func TestSessionReplay(t *testing.T) {
+	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	client, err := NewClientFromBytes([]byte(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "b831381d-6324-4d53-ad4f-8cda48b30811"
+	}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+	session, err := NewSession(id)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	rc := &recordConn{}
+	conn := client.Upgrade(rc, utils.VmessAddrDomain, []byte("localhost"), 80)
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+	request := rc.Bytes()
+
+	user, authBuf, err := session.Authentication(bytes.NewReader(request))
+	assert.Nil(t, err)
+	assert.Equal(t, request[:16], authBuf)
+	assert.Equal(t, session.Users()[0], user)
+
+	_, _, err = session.Authentication(bytes.NewReader(request))
+	assert.Equal(t, ErrReplayedAuthID, err)
+}
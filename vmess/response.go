@@ -1,11 +1,17 @@
 package vmess
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
 	"log"
 )
 
+// 应答中携带的指令类型
+const CmdSwitchAccount = byte(0x01)
+
+var ErrResponseAuthV = errors.New("respAuthV not match")
+
 func NewResponse(responseAuthV byte) *Response {
 	return &Response{responseAuthV: responseAuthV}
 }
@@ -13,6 +19,26 @@ func NewResponse(responseAuthV byte) *Response {
 type Response struct {
 	ResponseHeader
 	responseAuthV byte
+
+	SwitchAccount *SwitchAccount // 服务端下发的临时账户
+}
+
+// 设置下发的临时账户，为nil时不携带指令
+func (resp *Response) SetSwitchAccount(sa *SwitchAccount) { resp.SwitchAccount = sa }
+
+// 生成应答头部的明文：[ResponseHeader 4B][Command]
+func (resp *Response) MarshalBinary() ([]byte, error) {
+	if resp.SwitchAccount == nil {
+		resp.SetCommand()
+		return append([]byte{}, resp.ResponseHeader[:]...), nil
+	}
+
+	command, err := resp.SwitchAccount.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	resp.setCommand(CmdSwitchAccount, byte(len(command)))
+	return append(resp.ResponseHeader[:], command...), nil
 }
 
 func (resp *Response) ReadFrom(r io.Reader) (readed int64, retErr error) {
@@ -24,31 +50,100 @@ func (resp *Response) ReadFrom(r io.Reader) (readed int64, retErr error) {
 	}
 
 	if resp.GetV() != resp.responseAuthV {
-		return readed, errors.New("respAuthV not match")
+		return readed, ErrResponseAuthV
 	}
 	// if resp.GetOption() != 0 {
 	// 	return readed, errors.New("option is not 0")
 	// }
 	cmdSize := resp.GetCommandSize()
-	command := make([]byte, cmdSize) // 动态端口指令？
+	command := make([]byte, cmdSize)
 	n, retErr = io.ReadFull(r, command)
 	readed += int64(n)
 	if retErr != nil {
 		return readed, retErr
 	}
-	if resp.GetCommandType() == 1 {
-		log.Println("dynamic port command accept.")
+
+	switch resp.GetCommandType() {
+	case 0:
+	case CmdSwitchAccount:
+		sa := &SwitchAccount{}
+		if err := sa.UnmarshalBinary(command); err != nil {
+			// 指令解析失败不影响数据传输
+			log.Println("invalid switch account command: ", err)
+			break
+		}
+		resp.SwitchAccount = sa
+	default:
+		log.Printf("unknown response command: %v\n", resp.GetCommandType())
 	}
 
 	return readed, nil
 }
 
+// 动态端口指令，通知客户端在有效期内使用新的地址与账户
+// 结构：[fnv1a 4B][hostLen 1B][host][port 2B][uuid 16B][alterIds 2B][level 1B][validMin 1B]
+type SwitchAccount struct {
+	Host     string // 为空时使用原服务端地址
+	Port     uint16
+	ID       []byte
+	AlterIds uint16
+	Level    byte
+	ValidMin byte // 有效时长（分钟）
+}
+
+func (sa *SwitchAccount) MarshalBinary() ([]byte, error) {
+	if len(sa.ID) != 16 {
+		return nil, errors.New("invalid uuid")
+	}
+	// 指令长度使用1字节表示
+	if len(sa.Host) > 255-4-1-2-16-2-1-1 {
+		return nil, errors.New("host too long")
+	}
+
+	buf := make([]byte, 4, 4+1+len(sa.Host)+2+16+2+1+1)
+	buf = append(buf, byte(len(sa.Host)))
+	buf = append(buf, sa.Host...)
+	buf = binary.BigEndian.AppendUint16(buf, sa.Port)
+	buf = append(buf, sa.ID...)
+	buf = binary.BigEndian.AppendUint16(buf, sa.AlterIds)
+	buf = append(buf, sa.Level, sa.ValidMin)
+
+	binary.BigEndian.PutUint32(buf[0:4], GenBufsFnvSum(buf[4:]))
+	return buf, nil
+}
+
+func (sa *SwitchAccount) UnmarshalBinary(buf []byte) error {
+	if len(buf) < 5 {
+		return errors.New("command too short")
+	}
+	if binary.BigEndian.Uint32(buf[0:4]) != GenBufsFnvSum(buf[4:]) {
+		return errors.New("invalid command checksum")
+	}
+
+	buf = buf[4:]
+	hostLen := int(buf[0])
+	if len(buf) < 1+hostLen+2+16+2+1+1 {
+		return errors.New("command too short")
+	}
+	sa.Host = string(buf[1 : 1+hostLen])
+	buf = buf[1+hostLen:]
+
+	sa.Port = binary.BigEndian.Uint16(buf[0:2])
+	sa.ID = append([]byte{}, buf[2:18]...)
+	sa.AlterIds = binary.BigEndian.Uint16(buf[18:20])
+	sa.Level = buf[20]
+	sa.ValidMin = buf[21]
+	return nil
+}
+
 type ResponseHeader [4]byte
 
 func (h *ResponseHeader) SetV(v byte)           { h[0] = v }
 func (h *ResponseHeader) SetOption(option byte) { h[1] = option }
 func (h *ResponseHeader) SetCommand()           { h[2] = 0; h[3] = 0 }
 
+func (h *ResponseHeader) setCommand(t, size byte) { h[2] = t; h[3] = size }
+
 func (h *ResponseHeader) GetV() byte           { return h[0] }
 func (h *ResponseHeader) GetOption() byte      { return h[1] }
 func (h *ResponseHeader) GetCommandType() byte { return h[2] }
@@ -0,0 +1,122 @@
+package vmess
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwitchAccount(t *testing.T) {
+	userid, _ := utils.ParseUUID("27848739-7e62-4138-9fd3-098a63964b6b")
+	sa := &SwitchAccount{Host: "example.com", Port: 10086, ID: userid, AlterIds: 4, Level: 1, ValidMin: 5}
+
+	resp := NewResponse(0x12)
+	resp.SetV(0x12)
+	resp.SetSwitchAccount(sa)
+	buf, err := resp.MarshalBinary()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, CmdSwitchAccount, buf[2])
+	assert.Equal(t, len(buf)-4, int(buf[3]))
+
+	resp = NewResponse(0x12)
+	_, err = resp.ReadFrom(bytes.NewReader(buf))
+	assert.Nil(t, err)
+	assert.Equal(t, sa, resp.SwitchAccount)
+
+	// 校验和错误时忽略指令
+	buf[len(buf)-1]++
+	resp = NewResponse(0x12)
+	_, err = resp.ReadFrom(bytes.NewReader(buf))
+	assert.Nil(t, err)
+	assert.Nil(t, resp.SwitchAccount)
+}
+
+func TestClientSwitchAccount(t *testing.T) {
+	echoAddr := runTCPEchoServer(t)
+
+	id1 := "b831381d-6324-4d53-ad4f-8cda48b30811"
+	id2 := "27848739-7e62-4138-9fd3-098a63964b6b"
+
+	// 临时端口上的服务端只接受临时账户
+	detour, err := NewSession(id2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	accepted := make(chan struct{}, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go detour.Process(c, nil)
+		}
+	}()
+
+	session, err := NewSession(id1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	userid, _ := utils.ParseUUID(id2)
+	session.SetSwitchAccount(&SwitchAccount{
+		Port:     uint16(l.Addr().(*net.TCPAddr).Port),
+		ID:       userid,
+		ValidMin: 1,
+	})
+
+	client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v"
+	}`, id1)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	client.dial = func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go session.Process(c2, nil)
+		return c1, nil
+	}
+
+	echo := func() {
+		conn, err := client.Dial("tcp", utils.VmessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port))
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+		go conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(buf))
+	}
+
+	echo()
+	assert.Equal(t, 0, len(accepted))
+
+	// 收到指令后，新的连接使用临时端口与账户
+	echo()
+	assert.Equal(t, 1, len(accepted))
+
+	// 过期后恢复使用原配置
+	client.switched.Load().expire = time.Now()
+	echo()
+	assert.Equal(t, 1, len(accepted))
+}
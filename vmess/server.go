@@ -1,89 +1,274 @@
 package vmess
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/net-agent/protocol/utils"
 )
 
+var ErrReplayedAuthID = errors.New("replayed auth id")
+
 func NewSession(id string) (*Session, error) {
-	s := &Session{}
-	userid, err := utils.ParseUUID(id)
+	u, err := NewUser(id, "")
 	if err != nil {
 		return nil, err
 	}
-	copy(s.cmdKey[:], GenCmdKey(userid))
+	return NewSessionWithUsers(u)
+}
+
+func NewSessionWithUsers(users ...*User) (*Session, error) {
+	s := &Session{
+		// 时间戳误差为正负AuthTimeWindow，认证信息在两倍窗口内都可能被重放
+		replay: NewReplayFilter(2*AuthTimeWindow*time.Second, DefaultReplayCapacity),
+		legacy: newLegacyAuthTable(),
+		idle:   utils.DefaultIdleTimeout,
+
+		handshakeTimeout: utils.DefaultHandshakeTimeout,
+	}
+	for _, u := range users {
+		if err := s.AddUser(u); err != nil {
+			return nil, err
+		}
+	}
 	return s, nil
 }
 
 type Session struct {
-	cmdKey [16]byte
+	mu     sync.RWMutex
+	users  []*User // 写时复制，读取时无需长时间持有锁
+	replay *ReplayFilter
+	legacy *legacyAuthTable // 只包含alterId大于0的用户
+
+	switchAccount atomic.Pointer[SwitchAccount]
+	rand          io.Reader
+	idle          time.Duration
+	handler       Handler
+
+	handshakeTimeout time.Duration
+	fallbacks        utils.Fallbacks
+}
+
+// 设置认证与读取指令的超时时间，默认为utils.DefaultHandshakeTimeout
+// 0表示不限制，此时握手失败后立即关闭连接
+func (s *Session) SetHandshakeTimeout(d time.Duration) { s.handshakeTimeout = d }
+
+// 设置认证失败时的回落目标，参考utils.Fallbacks
+func (s *Session) SetFallbacks(fbs ...*utils.Fallback) { s.fallbacks = fbs }
+
+// 握手失败的处理：优先转发到匹配的回落目标，
+// 否则在超时前读取并丢弃随机长度的数据，参考utils.DrainConn
+func (s *Session) reject(c net.Conn, peek *utils.PeekConn, err error) error {
+	if peek != nil {
+		if ok, ferr := s.fallbacks.Serve(peek, s.idle); ok {
+			return ferr
+		}
+	}
+	if s.handshakeTimeout > 0 {
+		utils.DrainConn(c)
+	}
+	return err
+}
+
+// 设置请求的处理方式，传入nil时使用DialAndLink
+func (s *Session) SetHandler(h Handler) { s.handler = h }
+
+// 设置TCP转发的空闲超时时间，0表示不限制
+func (s *Session) SetIdleTimeout(d time.Duration) { s.idle = d }
+
+// 替换随机数来源，默认使用crypto/rand，仅用于测试
+func (s *Session) SetRand(r io.Reader) { s.rand = r }
+
+// 设置在应答中下发的临时账户，客户端在有效期内会使用新的地址与账户建立连接
+// 临时账户需要由监听该端口的Session接受，传入nil时停止下发
+func (s *Session) SetSwitchAccount(sa *SwitchAccount) {
+	s.switchAccount.Store(sa)
+}
+
+func (s *Session) AddUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, exist := range s.users {
+		if bytes.Equal(exist.ID, u.ID) {
+			return ErrUserExists
+		}
+	}
+
+	users := make([]*User, 0, len(s.users)+1)
+	users = append(users, s.users...)
+	s.users = append(users, u)
+	if u.AlterID() > 0 {
+		s.legacy.add(u)
+	}
+	return nil
+}
+
+func (s *Session) RemoveUser(id string) error {
+	userid, err := utils.ParseUUID(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, u := range s.users {
+		if bytes.Equal(u.ID, userid) {
+			users := make([]*User, 0, len(s.users)-1)
+			users = append(users, s.users[:i]...)
+			s.users = append(users, s.users[i+1:]...)
+			s.legacy.remove(u)
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+func (s *Session) Users() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*User{}, s.users...)
+}
+
+// 逐个尝试解密EAuId，找到对应的用户
+func (s *Session) FindUser(authBuf []byte) (*User, error) {
+	s.mu.RLock()
+	users := s.users
+	s.mu.RUnlock()
+
+	now := time.Now().Unix()
+	for _, u := range users {
+		if u.CheckEAuId(authBuf, now) == nil {
+			return u, nil
+		}
+	}
+	return nil, ErrUserNotFound
 }
 
 // 处理已经通过认证的链接
 func (s *Session) Process(c net.Conn, authBuf []byte) error {
 	defer c.Close()
 	var err error
+	var user *User
+
+	if s.handshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+
+	// 配置了回落时记录握手阶段读取的数据
+	r := io.Reader(c)
+	var peek *utils.PeekConn
+	if len(s.fallbacks) > 0 {
+		peek = utils.NewPeekConn(c, authBuf)
+		r = peek
+	}
 
 	// 如果没有传入authBuf，则需要从authBuf认证开始进行读取
 	if len(authBuf) == 0 {
-		authBuf, err = s.Authentication(c)
-		if err != nil {
-			return err
-		}
+		authBuf = make([]byte, 16)
+		_, err = io.ReadFull(r, authBuf)
+	}
+	var legacyTS int64
+	if err == nil {
+		user, legacyTS, err = s.authenticate(authBuf)
 	}
-
-	cmd, err := s.ReadCommand(c, authBuf)
 	if err != nil {
-		return err
+		return s.reject(c, peek, err)
 	}
 
-	t := utils.NewAddrType(utils.ProtoVmess, cmd.GetAddressType())
-	addr, err := utils.AddrString(t, cmd.addressData, cmd.GetPort())
+	cmd, err := s.readCommand(r, user, authBuf, legacyTS)
 	if err != nil {
-		return err
+		return s.reject(c, peek, err)
 	}
+	c.SetDeadline(time.Time{})
 
-	log.Printf("accepted. target='%v'\n", addr)
-
-	target, err := utils.Dial(addr)
+	req, err := newRequest(user, cmd)
 	if err != nil {
 		return err
 	}
-	defer target.Close()
-
-	if err := s.WriteResponse(c, cmd); err != nil {
-		return err
+	if req.Command == CmdMux {
+		log.Printf("accepted. user='%v' mux\n", user)
+	} else {
+		log.Printf("accepted. user='%v' target='%v'\n", user, req.Addr)
 	}
 
 	client, err := NewServerConn(c, cmd)
 	if err != nil {
 		return err
 	}
+	client.User = user
+	client.respond = func() error { return s.WriteResponse(c, cmd) }
 
-	utils.LinkAndLog(addr, target, client)
-	return nil
+	return s.handle(client, req)
 }
 
-func (s *Session) Authentication(r io.Reader) ([]byte, error) {
+// 读取认证信息并找到对应的用户
+func (s *Session) Authentication(r io.Reader) (*User, []byte, error) {
 	authInfo := make([]byte, 16)
 	_, err := io.ReadFull(r, authInfo)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	err = CheckEAuId(s.cmdKey[:], authInfo, time.Now().Unix())
+	user, _, err := s.authenticate(authInfo)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return user, authInfo, nil
+}
+
+// 判断认证信息是否属于本Session的用户，不进行防重放检查，用于协议识别
+func (s *Session) MatchAuthID(authInfo []byte) bool {
+	if _, err := s.FindUser(authInfo); err == nil {
+		return true
+	}
+	_, _, found := s.legacy.lookup(authInfo, time.Now().Unix())
+	return found
+}
+
+// 旧版认证时返回客户端使用的时间戳，AEAD认证时为0
+func (s *Session) authenticate(authInfo []byte) (*User, int64, error) {
+	user, err := s.FindUser(authInfo)
+	if err != nil {
+		// 旧版认证信息在同一秒内是相同的，不能用于防重放，读取指令后再检查
+		if user, timestamp, found := s.legacy.lookup(authInfo, time.Now().Unix()); found {
+			return user, timestamp, nil
+		}
+		return nil, 0, err
 	}
-	return authInfo, nil
+	if !s.replay.Check(authInfo) {
+		return nil, 0, ErrReplayedAuthID
+	}
+	return user, 0, nil
+}
+
+// 读取认证信息之后的指令部分，用于先调用Authentication的情况
+// 旧版认证需要重新查找时间戳，Process直接使用认证时的结果
+func (s *Session) ReadCommand(r io.Reader, user *User, authBuf []byte) (*Command, error) {
+	var legacyTS int64
+	if u, timestamp, found := s.legacy.lookup(authBuf, time.Now().Unix()); found && u == user {
+		legacyTS = timestamp
+	}
+	return s.readCommand(r, user, authBuf, legacyTS)
 }
 
-func (s *Session) ReadCommand(r io.Reader, authBuf []byte) (*Command, error) {
-	headerBuf, err := OpenAeadHeader(r, s.cmdKey, authBuf)
+// legacyTS不为0时按旧版格式解密指令
+func (s *Session) readCommand(r io.Reader, user *User, authBuf []byte, legacyTS int64) (*Command, error) {
+	var headerBuf []byte
+	var err error
+
+	legacy := legacyTS != 0
+	if legacy {
+		headerBuf, err = OpenLegacyHeader(r, user.cmdKey, legacyTS)
+	} else {
+		headerBuf, err = OpenAeadHeader(r, user.cmdKey, authBuf)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -92,9 +277,31 @@ func (s *Session) ReadCommand(r io.Reader, authBuf []byte) (*Command, error) {
 	if err != nil {
 		return nil, err
 	}
+	cmd.SetLegacy(legacy)
+	cmd.SetRand(s.rand)
+
+	// 与v2ray一致，旧版认证记录请求的key与iv，重放的请求会使用相同的key与iv
+	if legacy && !s.replay.Check(GenBufsMd5(cmd.GetRequestCipherKey(), cmd.GetRequestCipherIV())) {
+		return nil, ErrReplayedAuthID
+	}
 
-	if cmd.GetCommand() != CmdTCP {
-		return nil, errors.New("invalid command, only tcp supported")
+	if cmd.HashOption(OptionA) {
+		switch cmd.GetSecType() {
+		case SecTypeAES128GCM, SecTypeChaCha20Poly1305:
+		default:
+			return nil, errors.New("invalid option, auth length requires aead security")
+		}
+	}
+
+	switch cmd.GetCommand() {
+	case CmdTCP, CmdMux:
+	case CmdUDP:
+		// 数据包的边界依赖chunk分帧来保持
+		if !cmd.HashOption(OptionS) {
+			return nil, errors.New("invalid command, udp requires chunk stream")
+		}
+	default:
+		return nil, errors.New("invalid command, only tcp/udp/mux supported")
 	}
 
 	return cmd, nil
@@ -104,8 +311,31 @@ func (s *Session) WriteResponse(w io.Writer, cmd *Command) error {
 	resp := NewResponse(0)
 	resp.SetV(cmd.GetResponseAuthV())
 	resp.SetOption(cmd.GetOption())
+	resp.SetSwitchAccount(s.switchAccount.Load())
+	plain, err := resp.MarshalBinary()
+	if err != nil {
+		return err
+	}
 
 	key := cmd.GetResponseCipherKey()
 	iv := cmd.GetResponseCipherIV()
-	return SealAeadResponse(w, key, iv, resp.ResponseHeader[:])
+	if cmd.IsLegacy() {
+		cmd.responseStream, err = SealLegacyResponse(w, key, iv, plain)
+		return err
+	}
+	return SealAeadResponse(w, key, iv, plain)
+}
+
+// 在监听上处理vmess连接，连接管理参考utils.Server
+type Server struct {
+	*utils.Server
+	Session *Session
+}
+
+// maxConns为同时处理的最大连接数，0表示不限制
+func NewServer(s *Session, maxConns int) *Server {
+	return &Server{
+		Server:  utils.NewServer(func(c net.Conn) error { return s.Process(c, nil) }, maxConns),
+		Session: s,
+	}
 }
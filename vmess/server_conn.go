@@ -1,21 +1,17 @@
 package vmess
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sync"
 )
 
 func NewServerConn(raw net.Conn, command *Command) (*ServerConn, error) {
-	c := &ServerConn{raw, raw, raw}
+	c := &ServerConn{Conn: raw, command: command, dataReader: raw}
 
 	if command.GetSecType() == SecTypeAES128CFB {
-		stream, err := NewAesCfbEncStream(command.GetResponseCipherKey()[:16], command.GetResponseCipherIV()[:16])
-		if err != nil {
-			return nil, err
-		}
-		c.dataWriter = NewSecurityWriter(c.dataWriter, stream)
-
-		stream, err = NewAesCfbDecStream(command.GetRequestCipherKey(), command.GetRequestCipherIV())
+		stream, err := NewAesCfbDecStream(command.GetRequestCipherKey(), command.GetRequestCipherIV())
 		if err != nil {
 			return nil, err
 		}
@@ -23,17 +19,67 @@ func NewServerConn(raw net.Conn, command *Command) (*ServerConn, error) {
 	}
 
 	if command.HashOption(OptionS) {
-		c.dataWriter = NewChunkWriter(c.dataWriter, NewChunkWithCommand(command, false, true))
 		c.dataReader = NewChunkReader(c.dataReader, NewChunkWithCommand(command, false, false))
 	}
 
 	return c, nil
 }
 
+// Mux子连接不需要应答头部与加密，直接读写子连接
+func newStreamConn(st net.Conn, user *User) *ServerConn {
+	return &ServerConn{Conn: st, User: user, dataReader: st}
+}
+
+// 旧版认证时数据部分继续使用应答头部的加密流，所以在发送应答之后才能创建
+func (c *ServerConn) initWriter() error {
+	c.dataWriter = c.Conn
+	if c.command == nil {
+		return nil
+	}
+
+	if c.command.GetSecType() == SecTypeAES128CFB {
+		stream := c.command.responseStream
+		if stream == nil {
+			var err error
+			stream, err = NewAesCfbEncStream(c.command.GetResponseCipherKey()[:16], c.command.GetResponseCipherIV()[:16])
+			if err != nil {
+				return err
+			}
+		}
+		c.dataWriter = NewSecurityWriter(c.dataWriter, stream)
+	}
+
+	if c.command.HashOption(OptionS) {
+		c.dataWriter = NewChunkWriter(c.dataWriter, NewChunkWithCommand(c.command, false, true))
+	}
+	return nil
+}
+
 type ServerConn struct {
 	net.Conn
-	dataWriter io.Writer
+	User *User // 连接所属的用户
+
+	command    *Command
+	dataWriter io.Writer // 在Accept中创建
 	dataReader io.Reader
+
+	respond    func() error // 发送应答头部，由Session设置
+	acceptOnce sync.Once
+	acceptErr  error
+}
+
+// 发送应答头部，只会执行一次
+// 第一次写入数据时会自动调用
+func (c *ServerConn) Accept() error {
+	c.acceptOnce.Do(func() {
+		if c.respond != nil {
+			if c.acceptErr = c.respond(); c.acceptErr != nil {
+				return
+			}
+		}
+		c.acceptErr = c.initWriter()
+	})
+	return c.acceptErr
 }
 
 func (c *ServerConn) Read(buf []byte) (int, error) {
@@ -41,5 +87,30 @@ func (c *ServerConn) Read(buf []byte) (int, error) {
 }
 
 func (c *ServerConn) Write(buf []byte) (int, error) {
+	if err := c.Accept(); err != nil {
+		return 0, err
+	}
 	return c.dataWriter.Write(buf)
 }
+
+// 结束发送方向，参考ClientConn.CloseWrite
+func (c *ServerConn) CloseWrite() error {
+	if err := c.Accept(); err != nil {
+		return err
+	}
+	return closeWrite(c.dataWriter, c.Conn)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func closeWrite(dataWriter io.Writer, raw net.Conn) error {
+	if cw, ok := dataWriter.(*ChunkWriter); ok {
+		return cw.WriteEOF()
+	}
+	if cw, ok := raw.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/net-agent/protocol/utils"
 	"github.com/stretchr/testify/assert"
@@ -20,11 +21,11 @@ func TestSession(t *testing.T) {
 	// init client
 	id := "b831381d-6324-4d53-ad4f-8cda48b30811"
 	tmp := `{
-		"network": "tcp",
-		"address": "127.0.0.1",
+		"net": "tcp",
+		"add": "127.0.0.1",
 		"port": 20000,
 		"path": "/download",
-		"uuid": "%v",
+		"id": "%v",
 		"security": "%v",
 		"transport": "%v"
 	}`
@@ -36,6 +37,9 @@ func TestSession(t *testing.T) {
 		{"none", "stream"},
 		{"none", "chunk"},
 		{"none", "mask"},
+
+		{"zero", "stream"},
+		{"zero", "padding"}, // transport is ignored
 		// {"none", "padding"}, // invalid config
 
 		{"aes-128-cfb", "stream"},
@@ -47,11 +51,13 @@ func TestSession(t *testing.T) {
 		{"aes-128-gcm", "chunk"},
 		{"aes-128-gcm", "mask"},
 		{"aes-128-gcm", "padding"},
+		{"aes-128-gcm", "auth-length"},
 
 		// {"chacha20-poly1305", "stream"}, // invalid config
 		{"chacha20-poly1305", "chunk"},
 		{"chacha20-poly1305", "mask"},
 		{"chacha20-poly1305", "padding"},
+		{"chacha20-poly1305", "auth-length"},
 	}
 
 	for _, tt := range tests {
@@ -88,3 +94,26 @@ func TestSession(t *testing.T) {
 		})
 	}
 }
+
+func TestSessionHandshakeTimeout(t *testing.T) {
+	session, _ := NewSession("b831381d-6324-4d53-ad4f-8cda48b30811")
+	session.SetHandshakeTimeout(time.Millisecond * 100)
+
+	// 不发送任何数据的连接在超时后被关闭
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	start := time.Now()
+	assert.NotNil(t, session.Process(c2, nil))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// 认证失败后服务端继续读取数据，直到超时才关闭连接
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	errch := make(chan error, 1)
+	go func() { errch <- session.Process(c2, nil) }()
+	_, err := c1.Write(make([]byte, 16))
+	assert.Nil(t, err)
+	_, err = c1.Write(make([]byte, 16))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrUserNotFound, <-errch)
+}
@@ -0,0 +1,71 @@
+package vmess
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/net-agent/protocol/utils"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// 服务端的用户信息
+// cmdKey与AuthID的解密器在创建时预先计算，认证时逐个尝试即可
+type User struct {
+	Email string
+	ID    []byte
+
+	cmdKey     [16]byte
+	authCipher cipher.Block
+	alterIds   [][]byte // 旧版认证使用的派生id
+}
+
+func NewUser(id, email string) (*User, error) {
+	userid, err := utils.ParseUUID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{Email: email, ID: userid}
+	copy(u.cmdKey[:], GenCmdKey(userid))
+	u.authCipher, err = aes.NewCipher(GenKDF16Key(u.cmdKey[:], "AES Auth ID Encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// 创建同时支持旧版认证的用户，alterId为0时与NewUser相同
+func NewLegacyUser(id, email string, alterId int) (*User, error) {
+	u, err := NewUser(id, email)
+	if err != nil {
+		return nil, err
+	}
+	u.alterIds = NewAlterIDs(u.ID, alterId)
+	return u, nil
+}
+
+func (u *User) AlterID() int { return len(u.alterIds) }
+
+// 用于日志输出，没有设置Email时使用uuid
+func (u *User) String() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	id, _ := uuid.FromBytes(u.ID)
+	return id.String()
+}
+
+func (u *User) CmdKey() [16]byte { return u.cmdKey }
+
+// 使用预先计算的解密器校验EAuId
+func (u *User) CheckEAuId(authInfo []byte, timestamp int64) error {
+	data := make([]byte, 16)
+	u.authCipher.Decrypt(data, authInfo[:16])
+	return checkPlainAuthId(data, timestamp)
+}
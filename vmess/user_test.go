@@ -0,0 +1,75 @@
+package vmess
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-agent/protocol/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionUsers(t *testing.T) {
+	echoAddr := runTCPEchoServer(t)
+
+	ids := []string{
+		"b831381d-6324-4d53-ad4f-8cda48b30811",
+		"27848739-7e62-4138-9fd3-098a63964b6b",
+	}
+	var users []*User
+	for i, id := range ids {
+		u, err := NewUser(id, fmt.Sprintf("user%v@test", i))
+		if !assert.Nil(t, err) {
+			return
+		}
+		users = append(users, u)
+	}
+
+	session, err := NewSessionWithUsers(users...)
+	if !assert.Nil(t, err) {
+		return
+	}
+	session.SetHandshakeTimeout(time.Millisecond * 100)
+	assert.Equal(t, 2, len(session.Users()))
+	assert.Equal(t, ErrUserExists, session.AddUser(users[0]))
+
+	client, err := NewClientFromBytes([]byte(fmt.Sprintf(`{
+		"net": "tcp",
+		"add": "127.0.0.1",
+		"port": 20000,
+		"id": "%v",
+		"security": "aes-128-gcm",
+		"transport": "chunk"
+	}`, ids[1])))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	dial := func() (net.Conn, <-chan error) {
+		c1, c2 := net.Pipe()
+		errch := make(chan error, 1)
+		go func() { errch <- session.Process(c2, nil) }()
+		return client.Upgrade(c1, utils.VmessAddrIPv4, echoAddr.IP.To4(), uint16(echoAddr.Port)), errch
+	}
+
+	conn, _ := dial()
+	payload := []byte("hello from second user")
+	go conn.Write(payload)
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, buf)
+	conn.Close()
+
+	// 移除后不能再通过认证
+	assert.Nil(t, session.RemoveUser(ids[1]))
+	assert.Equal(t, ErrUserNotFound, session.RemoveUser(ids[1]))
+	assert.Equal(t, 1, len(session.Users()))
+
+	conn, errch := dial()
+	go conn.Write(payload)
+	assert.Equal(t, ErrUserNotFound, <-errch)
+	conn.Close()
+}
@@ -12,7 +12,6 @@ import (
 	"hash/crc32"
 	"hash/fnv"
 	"log"
-	"math/rand"
 )
 
 // 生成userid的16位hash值，使用MD5，并且加盐
@@ -42,6 +41,9 @@ func GenKDF16Key(key []byte, path ...string) []byte {
 	return GenKDFKey(key, path...)[:16]
 }
 
+// 认证信息中时间戳允许的误差（秒）
+const AuthTimeWindow = 120
+
 // 生成EAuId
 // 结构：[timestamp 8B][rand 4B][checksum 4B]
 func GenEAuId(cmdKey []byte, timestamp int64, rnd int) ([]byte, error) {
@@ -66,6 +68,11 @@ func CheckEAuId(cmdKey []byte, authInfo []byte, timestamp1 int64) error {
 	if err != nil {
 		return err
 	}
+	return checkPlainAuthId(data, timestamp1)
+}
+
+// 校验解密后的EAuId：校验和以及时间戳
+func checkPlainAuthId(data []byte, timestamp1 int64) error {
 	csum1 := crc32.ChecksumIEEE(data[0:12])
 	csum2 := binary.BigEndian.Uint32(data[12:16])
 	if csum1 != csum2 {
@@ -74,7 +81,7 @@ func CheckEAuId(cmdKey []byte, authInfo []byte, timestamp1 int64) error {
 
 	timestamp2 := int64(binary.BigEndian.Uint64(data[0:8]))
 	delta := timestamp1 - timestamp2
-	if delta < 120 && delta > -120 {
+	if delta < AuthTimeWindow && delta > -AuthTimeWindow {
 		return nil
 	}
 	return errors.New("invalid timestamp")
@@ -136,7 +143,7 @@ func GenAuthData(userid []byte, utcTimeBuf []byte) []byte {
 
 func GenUTCTimeBytes(t int64, delta int) []byte {
 	if delta > 0 {
-		n := rand.Intn(delta*2) - delta
+		n := randIntn(nil, delta*2) - delta
 		t = t + int64(n)
 	}
 	buf := make([]byte, 8)
@@ -145,14 +152,7 @@ func GenUTCTimeBytes(t int64, delta int) []byte {
 }
 
 func GenRandomBytes(size int) []byte {
-	if size == 0 {
-		return nil
-	}
-
-	buf := make([]byte, size)
-	rand.Read(buf)
-
-	return buf
+	return genRandomBytes(nil, size)
 }
 
 func NewAesCfbEncStream(key, iv []byte) (cipher.Stream, error) {